@@ -18,46 +18,73 @@ type CEO struct {
 
 func processLMACEO(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
 		ApplicationID     string `json:"application_id"`
 		SupervisorComment string `json:"comment"`
+		NextOfficer       string `json:"next_officer"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
 	// CEO Comment
 	ceoComment := []string{input.SupervisorComment}
 	ceoComment = append(ceoComment, "true")
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	if lma.AssignTo == "CEO" {
-		lma.AssignTo = "FinanceOfficer"
+		errResponse := authorizeLMAOfficer(stub, lma, "CEO")
+		if errResponse != nil {
+			return *errResponse
+		}
+
+		encumbrance, err := activeEncumbrance(stub, lma.PlotNumber)
+		if err != nil {
+			return ledgerError(err)
+		}
+		if encumbrance != nil {
+			return encumberedError(encumbrance)
+		}
+
+		errResponse = moveLMAToStage(stub, &lma, "FinanceOfficer", input.NextOfficer)
+		if errResponse != nil {
+			return *errResponse
+		}
 	}
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	return shim.Success(nil)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -33,6 +34,17 @@ type LandMutationApplication struct {
 	DateOfApplication string `json:"date_of_application"`
 	AssignTo          string `json:"assign_to"`
 	Status            string `json:"status"`
+
+	// Set from the transaction timestamp when the application is created
+	SubmittedOn string `json:"submitted_on"`
+
+	// Last action of the Estate Manager that handed the application back
+	// to the citizen, and the hearing date if one was set
+	EstateManagerAction string `json:"estate_manager_action"`
+	DateOfHearing       string `json:"date_of_hearing"`
+
+	// Officer handling the application at its current stage, if any
+	AssignedOfficer string `json:"assigned_officer"`
 }
 
 // Update
@@ -162,42 +174,71 @@ type Citizen struct {
 
 func createLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid argument count.")
+		return argCountError()
 	}
 
 	lma := LandMutationApplication{}
 	err := json.Unmarshal([]byte(args[0]), &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return inputError(err)
+	}
+
+	if len(lma.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+	if len(lma.AadharID) == 0 {
+		return requiredError("aadhar_id")
 	}
 
-	citizenKey, err := stub.CreateCompositeKey(prefixCitizen, []string{lma.AadharID})
+	citizenKey, err := createKey(stub, prefixCitizen, []string{lma.AadharID})
 	// Check if a user with the same username exists
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
+	}
+	citizenAsBytes, err := stub.GetState(citizenKey)
+	if err != nil {
+		return ledgerError(err)
 	}
-	citizenAsBytes, _ := stub.GetState(citizenKey)
 	if citizenAsBytes == nil {
-		return shim.Error("Citizen with this username does not exist.")
+		return lmaError(errCodeNotFound, "Citizen with this username does not exist.", "aadhar_id")
 	}
 
-	key, err := stub.CreateCompositeKey(prefixLMA, []string{lma.ApplicationID})
+	key, err := createKey(stub, prefixLMA, []string{lma.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	// Check if the user already exists
-	lmaAsBytes, _ := stub.GetState(key)
+	lmaAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return ledgerError(err)
+	}
 	// User does not exist, attempting creation
 	if len(lmaAsBytes) == 0 {
+		now, err := txTime(stub)
+		if err != nil {
+			return ledgerError(err)
+		}
+		lma.SubmittedOn = now.Format(time.RFC3339)
+
 		lmaAsBytes, err = json.Marshal(lma)
 		if err != nil {
-			return shim.Error(err.Error())
+			return internalError(err)
 		}
 
 		err = stub.PutState(key, lmaAsBytes)
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
+		}
+
+		err = recordLMAStat(stub, lma, statReceived)
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		err = indexLMAByAadhar(stub, lma)
+		if err != nil {
+			return ledgerError(err)
 		}
 
 		// Return nil, if user is newly created
@@ -206,7 +247,7 @@ func createLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	err = json.Unmarshal(lmaAsBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	lmaResponse := struct {
@@ -217,12 +258,93 @@ func createLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	lmaResponseAsBytes, err := json.Marshal(lmaResponse)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	// Return the username and the password of the already existing user
 	return shim.Success(lmaResponseAsBytes)
 }
 
+// indexLMAByAadhar records the application under the citizen's AadharID so
+// that a citizen's applications can be listed without a full scan
+func indexLMAByAadhar(stub shim.ChaincodeStubInterface, lma LandMutationApplication) error {
+	indexKey, err := createKey(stub, prefixAadharLMA, []string{lma.AadharID, lma.ApplicationID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// backfillAadharIndex indexes by AadharID the applications created before
+// the index existed, so that query_my_lma finds them. It indexes at most
+// limit applications with IDs after the given one per call and returns the
+// last ID indexed to continue from, empty once all are done. Applications
+// before the given ID are still read to reach it, so a large backlog is
+// best done with a large limit. Re-indexing an application is harmless.
+func backfillAadharIndex(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, "Supervisor")
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		After string `json:"after"`
+		Limit int    `json:"limit"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if input.Limit <= 0 {
+		return lmaError(errCodeInvalidInput, "limit must be positive.", "limit")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixLMA, []string{})
+	if err != nil {
+		return ledgerError(err)
+	}
+	defer resultsIterator.Close()
+
+	response := struct {
+		Indexed int    `json:"indexed"`
+		Last    string `json:"last_application_id"`
+	}{}
+	for resultsIterator.HasNext() && response.Indexed < input.Limit {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		lma := LandMutationApplication{}
+		err = json.Unmarshal(kvResult.Value, &lma)
+		if err != nil {
+			return internalError(err)
+		}
+		if lma.ApplicationID <= input.After {
+			continue
+		}
+
+		err = indexLMAByAadhar(stub, lma)
+		if err != nil {
+			return ledgerError(err)
+		}
+		response.Indexed++
+		response.Last = lma.ApplicationID
+	}
+	if !resultsIterator.HasNext() {
+		response.Last = ""
+	}
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(responseBytes)
+}
+
 func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	input := struct {
 		ApplicationID string `json:"application_id"`
@@ -230,7 +352,7 @@ func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) == 1 {
 		err := json.Unmarshal([]byte(args[0]), &input)
 		if err != nil {
-			return shim.Error(err.Error())
+			return inputError(err)
 		}
 	}
 	filterByApplicationID := len(input.ApplicationID) > 0
@@ -244,7 +366,7 @@ func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 		resultsIterator, err = stub.GetStateByPartialCompositeKey(prefixLMA, []string{})
 	}
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 	defer resultsIterator.Close()
 
@@ -253,7 +375,7 @@ func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	for resultsIterator.HasNext() {
 		kvResult, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
 		}
 
 		// Construct response struct
@@ -263,11 +385,14 @@ func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 		err = json.Unmarshal(kvResult.Value, &result)
 		if err != nil {
-			return shim.Error(err.Error())
+			return internalError(err)
 		}
 
 		// Fetch key
 		prefix, keyParts, err := stub.SplitCompositeKey(kvResult.Key)
+		if err != nil {
+			return ledgerError(err)
+		}
 		if len(keyParts) == 2 {
 			result.ApplicationID = keyParts[1]
 		} else {
@@ -278,39 +403,46 @@ func listLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	resultsAsBytes, err := json.Marshal(results)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	return shim.Success(resultsAsBytes)
 }
 
 func createCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid argument count.")
+		return argCountError()
 	}
 
 	citizen := Citizen{}
 	err := json.Unmarshal([]byte(args[0]), &citizen)
 	if err != nil {
-		return shim.Error(err.Error())
+		return inputError(err)
 	}
 
-	key, err := stub.CreateCompositeKey(prefixCitizen, []string{citizen.AadharID})
+	if len(citizen.AadharID) == 0 {
+		return requiredError("aadhar_id")
+	}
+
+	key, err := createKey(stub, prefixCitizen, []string{citizen.AadharID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	// Check if the user already exists
-	citizenAsBytes, _ := stub.GetState(key)
+	citizenAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return ledgerError(err)
+	}
 	// User does not exist, attempting creation
 	if len(citizenAsBytes) == 0 {
 		citizenAsBytes, err = json.Marshal(citizen)
 		if err != nil {
-			return shim.Error(err.Error())
+			return internalError(err)
 		}
 
 		err = stub.PutState(key, citizenAsBytes)
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
 		}
 
 		// Return nil, if user is newly created
@@ -319,7 +451,7 @@ func createCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 	err = json.Unmarshal(citizenAsBytes, &citizen)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	citizenResponse := struct {
@@ -330,7 +462,7 @@ func createCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 	citizenResponseAsBytes, err := json.Marshal(citizenResponse)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	// Return the username and the password of the already existing user
 	return shim.Success(citizenResponseAsBytes)
@@ -338,7 +470,7 @@ func createCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response
 
 func getCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid argument count.")
+		return argCountError()
 	}
 
 	input := struct {
@@ -347,14 +479,17 @@ func getCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	err := json.Unmarshal([]byte(args[0]), &input)
 	if err != nil {
-		return shim.Error(err.Error())
+		return inputError(err)
 	}
 
-	userKey, err := stub.CreateCompositeKey(prefixCitizen, []string{input.AadharID})
+	userKey, err := createKey(stub, prefixCitizen, []string{input.AadharID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
+	}
+	userBytes, err := stub.GetState(userKey)
+	if err != nil {
+		return ledgerError(err)
 	}
-	userBytes, _ := stub.GetState(userKey)
 	if len(userBytes) == 0 {
 		return shim.Success(nil)
 	}
@@ -362,25 +497,24 @@ func getCitizen(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	response := struct {
 		AadharID   string `json:"aadhar_id"`
 		UserName   string `json:"user_name"`
-		Password   string `json:"password"`
 		LastName   string `json:"last_name"`
 		Address    string `json:"address"`
 		FatherName string `json:"father_name"`
 	}{}
 	err = json.Unmarshal(userBytes, &response)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	responseBytes, err := json.Marshal(response)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	return shim.Success(responseBytes)
 }
 
 func citizenAcceptHearingDate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
@@ -388,21 +522,31 @@ func citizenAcceptHearingDate(stub shim.ChaincodeStubInterface, args []string) p
 		AcceptHearingDate bool   `json:"accept_hearing_date"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	if lma.AssignTo == "Citizen" {
@@ -413,12 +557,98 @@ func citizenAcceptHearingDate(stub shim.ChaincodeStubInterface, args []string) p
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	return shim.Success(nil)
 }
+
+// citizenPendingAction names what the citizen has to do next, if anything
+func citizenPendingAction(lma LandMutationApplication) string {
+	if lma.AssignTo != "Citizen" {
+		return ""
+	}
+	if lma.EstateManagerAction == "ApplicationSentForCorrection" {
+		return "CorrectApplication"
+	}
+	return "AcceptHearingDate"
+}
+
+func listMyLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return argCountError()
+	}
+
+	aadharID, err := resolveCallerAadharID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixAadharLMA, []string{aadharID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	defer resultsIterator.Close()
+
+	type myLMA struct {
+		ApplicationID     string `json:"application_id"`
+		PlotNumber        string `json:"plot_number"`
+		DateOfApplication string `json:"date_of_application"`
+		Status            string `json:"status"`
+		AssignTo          string `json:"assign_to"`
+		PendingAction     string `json:"pending_action"`
+		DateOfHearing     string `json:"date_of_hearing"`
+	}
+	results := []myLMA{}
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError(err)
+		}
+		_, keyParts, err := stub.SplitCompositeKey(kvResult.Key)
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		lmaKey, err := createKey(stub, prefixLMA, []string{keyParts[1]})
+		if err != nil {
+			return ledgerError(err)
+		}
+		lmaBytes, err := stub.GetState(lmaKey)
+		if err != nil {
+			return ledgerError(err)
+		}
+		if len(lmaBytes) == 0 {
+			continue
+		}
+
+		lma := LandMutationApplication{}
+		err = json.Unmarshal(lmaBytes, &lma)
+		if err != nil {
+			return internalError(err)
+		}
+
+		result := myLMA{
+			ApplicationID:     lma.ApplicationID,
+			PlotNumber:        lma.PlotNumber,
+			DateOfApplication: lma.DateOfApplication,
+			Status:            lma.Status,
+			AssignTo:          lma.AssignTo,
+			PendingAction:     citizenPendingAction(lma),
+		}
+		if lma.EstateManagerAction == "SetHearingDate" {
+			result.DateOfHearing = lma.DateOfHearing
+		}
+		results = append(results, result)
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
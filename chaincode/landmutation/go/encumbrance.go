@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Role maintaining the encumbrance registry
+const roleRegistrar = "Registrar"
+
+/* Define the Encumbrance structure, a litigation, court stay or mortgage
+   recorded against a plot. An empty EndDate means open ended. Key consist of
+   prefix + PlotNumber + EncumbranceID
+*/
+type Encumbrance struct {
+	EncumbranceID    string `json:"encumbrance_id"`
+	PlotNumber       string `json:"plot_number"`
+	Type             string `json:"type"`
+	IssuingAuthority string `json:"issuing_authority"`
+	StartDate        string `json:"start_date"`
+	EndDate          string `json:"end_date"`
+	Reference        string `json:"reference"`
+	RecordedBy       string `json:"recorded_by"`
+}
+
+// isActive reports whether the encumbrance covers the given YYYY-MM-DD day
+func (e Encumbrance) isActive(day string) bool {
+	return e.StartDate <= day && (len(e.EndDate) == 0 || day <= e.EndDate)
+}
+
+// activeEncumbrance returns the first encumbrance on the plot in force at
+// the time of the transaction, or nil if the plot is clear
+func activeEncumbrance(stub shim.ChaincodeStubInterface, plotNumber string) (*Encumbrance, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := now.Format(dateLayout)
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixEncumbrance, []string{plotNumber})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		encumbrance := Encumbrance{}
+		err = json.Unmarshal(kvResult.Value, &encumbrance)
+		if err != nil {
+			return nil, err
+		}
+		if encumbrance.isActive(today) {
+			return &encumbrance, nil
+		}
+	}
+	return nil, nil
+}
+
+// encumberedError reports why an application cannot progress past the plot's
+// encumbrance
+func encumberedError(encumbrance *Encumbrance) pb.Response {
+	message := fmt.Sprintf("Plot %s is under %s, reference %s issued by %s from %s",
+		encumbrance.PlotNumber, encumbrance.Type, encumbrance.Reference, encumbrance.IssuingAuthority, encumbrance.StartDate)
+	if len(encumbrance.EndDate) > 0 {
+		message += " until " + encumbrance.EndDate
+	}
+	return lmaError(errCodeEncumbered, message, "plot_number")
+}
+
+func createEncumbrance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, roleRegistrar)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+	registrarID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	encumbrance := Encumbrance{}
+	err = json.Unmarshal([]byte(args[0]), &encumbrance)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(encumbrance.PlotNumber) == 0 {
+		return requiredError("plot_number")
+	}
+	switch encumbrance.Type {
+	case "Litigation", "CourtStay", "Mortgage":
+	default:
+		return lmaError(errCodeInvalidInput, "Type must be one of Litigation, CourtStay or Mortgage.", "type")
+	}
+	if len(encumbrance.IssuingAuthority) == 0 {
+		return requiredError("issuing_authority")
+	}
+	if len(encumbrance.Reference) == 0 {
+		return requiredError("reference")
+	}
+	if _, err := time.Parse(dateLayout, encumbrance.StartDate); err != nil {
+		return lmaError(errCodeInvalidInput, "Dates must be formatted as YYYY-MM-DD.", "start_date")
+	}
+	if len(encumbrance.EndDate) > 0 {
+		if _, err := time.Parse(dateLayout, encumbrance.EndDate); err != nil {
+			return lmaError(errCodeInvalidInput, "Dates must be formatted as YYYY-MM-DD.", "end_date")
+		}
+		if encumbrance.EndDate < encumbrance.StartDate {
+			return lmaError(errCodeInvalidInput, "end_date is before start_date.", "end_date")
+		}
+	}
+
+	encumbrance.EncumbranceID = stub.GetTxID()
+	encumbrance.RecordedBy = registrarID
+
+	key, err := createKey(stub, prefixEncumbrance, []string{encumbrance.PlotNumber, encumbrance.EncumbranceID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	encumbranceBytes, err := json.Marshal(encumbrance)
+	if err != nil {
+		return internalError(err)
+	}
+	err = stub.PutState(key, encumbranceBytes)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	response := struct {
+		EncumbranceID string `json:"encumbrance_id"`
+	}{
+		EncumbranceID: encumbrance.EncumbranceID,
+	}
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(responseBytes)
+}
+
+// releaseEncumbrance closes an encumbrance by setting its end date, the
+// record itself is kept
+func releaseEncumbrance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, roleRegistrar)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		PlotNumber    string `json:"plot_number"`
+		EncumbranceID string `json:"encumbrance_id"`
+		EndDate       string `json:"end_date"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.PlotNumber) == 0 {
+		return requiredError("plot_number")
+	}
+	if len(input.EncumbranceID) == 0 {
+		return requiredError("encumbrance_id")
+	}
+	if _, err := time.Parse(dateLayout, input.EndDate); err != nil {
+		return lmaError(errCodeInvalidInput, "Dates must be formatted as YYYY-MM-DD.", "end_date")
+	}
+
+	key, err := createKey(stub, prefixEncumbrance, []string{input.PlotNumber, input.EncumbranceID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	encumbranceBytes, err := stub.GetState(key)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if len(encumbranceBytes) == 0 {
+		return lmaError(errCodeNotFound, "Encumbrance does not exist.", "encumbrance_id")
+	}
+
+	encumbrance := Encumbrance{}
+	err = json.Unmarshal(encumbranceBytes, &encumbrance)
+	if err != nil {
+		return internalError(err)
+	}
+	if input.EndDate < encumbrance.StartDate {
+		return lmaError(errCodeInvalidInput, "end_date is before start_date.", "end_date")
+	}
+	encumbrance.EndDate = input.EndDate
+
+	encumbranceBytes, err = json.Marshal(encumbrance)
+	if err != nil {
+		return internalError(err)
+	}
+	err = stub.PutState(key, encumbranceBytes)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+func listEncumbrances(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	input := struct {
+		PlotNumber string `json:"plot_number"`
+	}{}
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.PlotNumber) == 0 {
+		return requiredError("plot_number")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return ledgerError(err)
+	}
+	today := now.Format(dateLayout)
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixEncumbrance, []string{input.PlotNumber})
+	if err != nil {
+		return ledgerError(err)
+	}
+	defer resultsIterator.Close()
+
+	type encumbranceResult struct {
+		Encumbrance
+		Active bool `json:"active"`
+	}
+	results := []encumbranceResult{}
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		result := encumbranceResult{}
+		err = json.Unmarshal(kvResult.Value, &result.Encumbrance)
+		if err != nil {
+			return internalError(err)
+		}
+		result.Active = result.isActive(today)
+		results = append(results, result)
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
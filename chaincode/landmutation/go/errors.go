@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Error codes returned in the LMAError envelope. The portal branches and
+// localizes on these, so existing values must not change.
+const (
+	errCodeInvalidFunction = "INVALID_FUNCTION"
+	errCodeInvalidArgCount = "INVALID_ARGUMENT_COUNT"
+	errCodeInvalidInput    = "INVALID_INPUT"
+	errCodeNotFound        = "NOT_FOUND"
+	errCodeInvalidState    = "INVALID_STATE"
+	errCodeUnauthorized    = "UNAUTHORIZED"
+	errCodeEncumbered      = "ENCUMBERED"
+	errCodeLedger          = "LEDGER_ERROR"
+	errCodeInternal        = "INTERNAL_ERROR"
+)
+
+/* Define the LMAError structure, the JSON envelope carried in the message
+   of every error response. Field names the offending input attribute,
+   if any.
+*/
+type LMAError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+func lmaError(code string, message string, field string) pb.Response {
+	errorBytes, err := json.Marshal(LMAError{Code: code, Message: message, Field: field})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Error(string(errorBytes))
+}
+
+func argCountError() pb.Response {
+	return lmaError(errCodeInvalidArgCount, "Invalid Arguments Count.", "")
+}
+
+// inputError reports a client payload that could not be decoded, naming
+// the field when the decoder knows it
+func inputError(err error) pb.Response {
+	field := ""
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		field = typeErr.Field
+	}
+	return lmaError(errCodeInvalidInput, err.Error(), field)
+}
+
+func requiredError(field string) pb.Response {
+	return lmaError(errCodeInvalidInput, field+" is required.", field)
+}
+
+func lmaNotFoundError() pb.Response {
+	return lmaError(errCodeNotFound, "Land Mutation Application ID does not exist", "application_id")
+}
+
+// keyError is a composite key that could not be built from client input,
+// e.g. an attribute which is not valid UTF-8
+type keyError struct {
+	err error
+}
+
+func (e keyError) Error() string {
+	return e.err.Error()
+}
+
+// createKey builds a composite key, marking a failure as a keyError so that
+// it is reported as invalid input rather than a ledger error
+func createKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) (string, error) {
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return "", keyError{err}
+	}
+	return key, nil
+}
+
+// errorResponse is used by checks which return an error response, or nil
+// if the check passes
+func errorResponse(response pb.Response) *pb.Response {
+	return &response
+}
+
+func ledgerError(err error) pb.Response {
+	if _, ok := err.(keyError); ok {
+		return lmaError(errCodeInvalidInput, err.Error(), "")
+	}
+	return lmaError(errCodeLedger, err.Error(), "")
+}
+
+func internalError(err error) pb.Response {
+	return lmaError(errCodeInternal, err.Error(), "")
+}
@@ -19,7 +19,7 @@ type EstateManager struct {
 
 func processLMAEstateManager(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
@@ -29,44 +29,74 @@ func processLMAEstateManager(stub shim.ChaincodeStubInterface, args []string) pb
 		DateOfHearing       string `json:"date_of_hearing"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
 	// Estate  Manager Comment
 	estateManagerComment := []string{input.EstateMangerComment}
 	estateManagerComment = append(estateManagerComment, "true")
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	if lma.AssignTo == "EstateManager" {
+		errResponse := authorizeLMAOfficer(stub, lma, "EstateManager")
+		if errResponse != nil {
+			return *errResponse
+		}
+
 		if input.EstateMangerAction == "SetHearingDate" || input.EstateMangerAction == "ApplicationSentForCorrection" {
-			lma.AssignTo = "Citizen"
+			errResponse = moveLMAToStage(stub, &lma, "Citizen", "")
+			if errResponse != nil {
+				return *errResponse
+			}
 			lma.Status = "Inprogress"
+			lma.EstateManagerAction = input.EstateMangerAction
+			if input.EstateMangerAction == "SetHearingDate" {
+				lma.DateOfHearing = input.DateOfHearing
+			}
 		} else if input.EstateMangerAction == "ApplicationRejected" {
-			lma.AssignTo = ""
+			errResponse = moveLMAToStage(stub, &lma, "", "")
+			if errResponse != nil {
+				return *errResponse
+			}
 			lma.Status = "Rejected"
+
+			err = recordLMAStat(stub, lma, statRejected)
+			if err != nil {
+				return ledgerError(err)
+			}
 		}
 	}
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	return shim.Success(nil)
@@ -74,46 +104,64 @@ func processLMAEstateManager(stub shim.ChaincodeStubInterface, args []string) pb
 
 func estateManagerHearing(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
 		ApplicationID        string `json:"application_id"`
 		EstateManagerComment string `json:"comment"`
+		NextOfficer          string `json:"next_officer"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
 	// Estate Manager Hearing Comment
 	estateManagerHearingComment := []string{input.EstateManagerComment}
 	estateManagerHearingComment = append(estateManagerHearingComment, "true")
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	if lma.AssignTo == "EstateManager" {
-		lma.AssignTo = "CEO"
+		errResponse := authorizeLMAOfficer(stub, lma, "EstateManager")
+		if errResponse != nil {
+			return *errResponse
+		}
+		errResponse = moveLMAToStage(stub, &lma, "CEO", input.NextOfficer)
+		if errResponse != nil {
+			return *errResponse
+		}
 	}
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	return shim.Success(nil)
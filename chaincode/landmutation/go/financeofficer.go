@@ -18,7 +18,7 @@ type FinanceOffice struct {
 
 func processLMAFinanceOfficer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
@@ -26,39 +26,71 @@ func processLMAFinanceOfficer(stub shim.ChaincodeStubInterface, args []string) p
 		ConfirmPayment bool   `json:"confirm_payment"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
 	if lma.AssignTo == "FinanceOfficer" {
+		errResponse := authorizeLMAOfficer(stub, lma, "FinanceOfficer")
+		if errResponse != nil {
+			return *errResponse
+		}
+
 		if lma.Status == "Complete" {
-			return shim.Error("Payment Confirmation already complete")
+			return lmaError(errCodeInvalidState, "Payment Confirmation already complete", "")
 		}
 		if input.ConfirmPayment {
+			encumbrance, err := activeEncumbrance(stub, lma.PlotNumber)
+			if err != nil {
+				return ledgerError(err)
+			}
+			if encumbrance != nil {
+				return encumberedError(encumbrance)
+			}
+
 			lma.Status = "Complete"
+			err = releaseAssignedOfficer(stub, &lma)
+			if err != nil {
+				return ledgerError(err)
+			}
+
+			err = recordLMAStat(stub, lma, statCompleted)
+			if err != nil {
+				return ledgerError(err)
+			}
 		}
 	}
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
 	return shim.Success(nil)
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Certificate attributes issued by the CA
+const (
+	// AadharID of a citizen
+	attrAadharID = "aadhar_id"
+	// Role of an officer, one of the AssignTo stages
+	attrRole = "role"
+	// ID of an officer in the officer registry
+	attrOfficerID = "officer_id"
+)
+
+// resolveCallerAadharID returns the AadharID of the invoking citizen, taken
+// from their certificate attribute or, failing that, from an identity
+// linked with citizen_link and approved by a registrar
+func resolveCallerAadharID(stub shim.ChaincodeStubInterface) (string, error) {
+	aadharID, found, err := cid.GetAttributeValue(stub, attrAadharID)
+	if err != nil {
+		return "", err
+	}
+	if found && len(aadharID) > 0 {
+		return aadharID, nil
+	}
+
+	clientID, err := cid.GetID(stub)
+	if err != nil {
+		return "", err
+	}
+	key, err := createKey(stub, prefixCitizenIdentity, []string{clientID})
+	if err != nil {
+		return "", err
+	}
+	aadharBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if len(aadharBytes) == 0 {
+		return "", errors.New("Caller is not linked to a citizen.")
+	}
+	return string(aadharBytes), nil
+}
+
+/* Define the CitizenLinkRequest structure, a request by a client identity
+   to act as a citizen, pending until a registrar reviews it. Key consist of
+   prefix + ClientID
+*/
+type CitizenLinkRequest struct {
+	ClientID    string `json:"client_id"`
+	AadharID    string `json:"aadhar_id"`
+	RequestedOn string `json:"requested_on"`
+}
+
+// linkCitizenIdentity requests that the caller's client identity be bound
+// to a citizen record. Nothing a caller sends can prove they are the
+// citizen, so the link only takes effect once a registrar approves it with
+// citizen_link_review. Citizens whose certificate carries the aadhar_id
+// attribute need no link.
+func linkCitizenIdentity(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	input := struct {
+		AadharID string `json:"aadhar_id"`
+	}{}
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.AadharID) == 0 {
+		return requiredError("aadhar_id")
+	}
+
+	citizenKey, err := createKey(stub, prefixCitizen, []string{input.AadharID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	citizenBytes, err := stub.GetState(citizenKey)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if len(citizenBytes) == 0 {
+		return lmaError(errCodeNotFound, "Citizen with this username does not exist.", "aadhar_id")
+	}
+
+	clientID, err := cid.GetID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return ledgerError(err)
+	}
+	request := CitizenLinkRequest{ClientID: clientID, AadharID: input.AadharID, RequestedOn: now.Format(time.RFC3339)}
+
+	key, err := createKey(stub, prefixCitizenLinkRequest, []string{clientID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return internalError(err)
+	}
+	err = stub.PutState(key, requestBytes)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// reviewCitizenLink lets a registrar approve or reject a pending link
+// request, having checked the citizen's documents off the ledger
+func reviewCitizenLink(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, roleRegistrar)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		ClientID string `json:"client_id"`
+		Approve  bool   `json:"approve"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.ClientID) == 0 {
+		return requiredError("client_id")
+	}
+
+	requestKey, err := createKey(stub, prefixCitizenLinkRequest, []string{input.ClientID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	requestBytes, err := stub.GetState(requestKey)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if len(requestBytes) == 0 {
+		return lmaError(errCodeNotFound, "No link request is pending for this client.", "client_id")
+	}
+	request := CitizenLinkRequest{}
+	err = json.Unmarshal(requestBytes, &request)
+	if err != nil {
+		return internalError(err)
+	}
+
+	if input.Approve {
+		key, err := createKey(stub, prefixCitizenIdentity, []string{request.ClientID})
+		if err != nil {
+			return ledgerError(err)
+		}
+		err = stub.PutState(key, []byte(request.AadharID))
+		if err != nil {
+			return ledgerError(err)
+		}
+	}
+	err = stub.DelState(requestKey)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// listCitizenLinkRequests returns the link requests awaiting review
+func listCitizenLinkRequests(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, roleRegistrar)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixCitizenLinkRequest, []string{})
+	if err != nil {
+		return ledgerError(err)
+	}
+	defer resultsIterator.Close()
+
+	results := []CitizenLinkRequest{}
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError(err)
+		}
+		request := CitizenLinkRequest{}
+		err = json.Unmarshal(kvResult.Value, &request)
+		if err != nil {
+			return internalError(err)
+		}
+		results = append(results, request)
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
+
+// assertCallerRole fails unless the caller's certificate carries the role
+func assertCallerRole(stub shim.ChaincodeStubInterface, role string) error {
+	return cid.AssertAttributeValue(stub, attrRole, role)
+}
+
+// resolveCallerOfficerID returns the officer ID from the caller's certificate
+func resolveCallerOfficerID(stub shim.ChaincodeStubInterface) (string, error) {
+	officerID, found, err := cid.GetAttributeValue(stub, attrOfficerID)
+	if err != nil {
+		return "", err
+	}
+	if !found || len(officerID) == 0 {
+		return "", errors.New("Caller is not an officer.")
+	}
+	return officerID, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -10,6 +11,15 @@ import (
 
 const prefixLMA = "lma"
 const prefixCitizen = "citizen"
+const prefixLMAStats = "lma_stats"
+const prefixCitizenIdentity = "citizen_identity"
+const prefixCitizenLinkRequest = "citizen_link_request"
+const prefixAadharLMA = "aadhar~applicationID"
+const prefixLMATrail = "lma_trail"
+const prefixOfficer = "officer"
+const prefixOfficerLMA = "officer~applicationID"
+const prefixDelegation = "delegate~officer~delegationID"
+const prefixEncumbrance = "encumbrance"
 
 var logger = shim.NewLogger("main")
 
@@ -23,6 +33,11 @@ var bcFunctions = map[string]func(shim.ChaincodeStubInterface, []string) pb.Resp
 	"citizen_create": createCitizen,
 	"query_citizen":  getCitizen,
 	"accept_citizen": citizenAcceptHearingDate,
+	"citizen_link":   linkCitizenIdentity,
+	"query_my_lma":   listMyLMA,
+
+	// Reporting
+	"query_lma_stats": queryLMAStats,
 
 	// CEO
 	"poa_ceo": processLMACEO,
@@ -32,10 +47,26 @@ var bcFunctions = map[string]func(shim.ChaincodeStubInterface, []string) pb.Resp
 	"estate_manager_hearing": estateManagerHearing,
 
 	// Supervisor
-	"poa_supervisor": processLMASupervisor,
+	"poa_supervisor":     processLMASupervisor,
+	"lma_reassign":       reassignLMA,
+	"officer_create":     createOfficer,
+	"lma_index_backfill": backfillAadharIndex,
+
+	// Officers
+	"lma_delegate":        delegateLMAQueue,
+	"lma_delegate_revoke": revokeDelegation,
+	"query_officer_queue": listOfficerQueue,
+	"query_lma_trail":     listLMATrail,
 
 	// Finance Officer
 	"poa_finance_officer": processLMAFinanceOfficer,
+
+	// Registrar
+	"citizen_link_review": reviewCitizenLink,
+	"query_citizen_link":  listCitizenLinkRequests,
+	"encumbrance_create":  createEncumbrance,
+	"encumbrance_release": releaseEncumbrance,
+	"query_encumbrance":   listEncumbrances,
 }
 
 // Init callback representing the invocation of a chaincode
@@ -57,7 +88,7 @@ func (t *SmartContract) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 
 	bcFunc := bcFunctions[function]
 	if bcFunc == nil {
-		return shim.Error("Invalid invoke function.")
+		return lmaError(errCodeInvalidFunction, "Invalid invoke function.", "")
 	}
 	return bcFunc(stub, args)
 }
@@ -74,14 +105,17 @@ func (t *SmartContract) initLedger(stub shim.ChaincodeStubInterface) pb.Response
 	i := 0
 	for i < len(user) {
 		fmt.Println("i is ", i)
-		userAsBytes, _ := json.Marshal(user[i])
-		key, err := stub.CreateCompositeKey(prefixCitizen, []string{user[i].AadharID})
+		userAsBytes, err := json.Marshal(user[i])
 		if err != nil {
-			return shim.Error(err.Error())
+			return internalError(err)
 		}
-		stub.PutState(key, userAsBytes)
+		key, err := createKey(stub, prefixCitizen, []string{user[i].AadharID})
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
+		}
+		err = stub.PutState(key, userAsBytes)
+		if err != nil {
+			return ledgerError(err)
 		}
 		fmt.Println("Added:", user[i])
 		i = i + 1
@@ -98,14 +132,21 @@ func (t *SmartContract) initLedger(stub shim.ChaincodeStubInterface) pb.Response
 	i = 0
 	for i < len(lma) {
 		fmt.Println("i is ", i)
-		lmaAsBytes, _ := json.Marshal(lma[i])
-		key, err := stub.CreateCompositeKey(prefixLMA, []string{lma[i].ApplicationID})
+		lmaAsBytes, err := json.Marshal(lma[i])
+		if err != nil {
+			return internalError(err)
+		}
+		key, err := createKey(stub, prefixLMA, []string{lma[i].ApplicationID})
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
 		}
-		stub.PutState(key, lmaAsBytes)
+		err = stub.PutState(key, lmaAsBytes)
 		if err != nil {
-			return shim.Error(err.Error())
+			return ledgerError(err)
+		}
+		err = indexLMAByAadhar(stub, lma[i])
+		if err != nil {
+			return ledgerError(err)
 		}
 		fmt.Println("Application Added:", lma[i])
 		i = i + 1
@@ -114,6 +155,15 @@ func (t *SmartContract) initLedger(stub shim.ChaincodeStubInterface) pb.Response
 	return shim.Success(nil)
 }
 
+// txTime returns the transaction timestamp proposed by the client
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
 func main() {
 	logger.SetLevel(shim.LogInfo)
 
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// dateLayout is the format of delegation dates
+const dateLayout = "2006-01-02"
+
+/* Define the Officer structure, an officer handling applications at one
+   stage. Role is one of the AssignTo values. Key consist of
+   prefix + OfficerID
+*/
+type Officer struct {
+	OfficerID      string `json:"id"`
+	Role           string `json:"role"`
+	FirstName      string `json:"first_name"`
+	LastName       string `json:"last_name"`
+	DepartmentName string `json:"department_name"`
+}
+
+/* Define the Delegation structure, an officer handing their queue to
+   another officer of the same role for a date range, both inclusive.
+   Key consist of
+   prefix + DelegateID + OfficerID + DelegationID
+*/
+type Delegation struct {
+	DelegationID string `json:"delegation_id"`
+	OfficerID    string `json:"officer_id"`
+	DelegateID   string `json:"delegate_id"`
+	Role         string `json:"role"`
+	FromDate     string `json:"from_date"`
+	ToDate       string `json:"to_date"`
+	Reason       string `json:"reason"`
+}
+
+func getOfficer(stub shim.ChaincodeStubInterface, officerID string) (*Officer, error) {
+	key, err := createKey(stub, prefixOfficer, []string{officerID})
+	if err != nil {
+		return nil, err
+	}
+	officerBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(officerBytes) == 0 {
+		return nil, nil
+	}
+
+	officer := Officer{}
+	err = json.Unmarshal(officerBytes, &officer)
+	if err != nil {
+		return nil, err
+	}
+	return &officer, nil
+}
+
+// setAssignedOfficer moves the application to the officer and keeps the
+// officer~applicationID index in step
+func setAssignedOfficer(stub shim.ChaincodeStubInterface, lma *LandMutationApplication, officerID string) error {
+	err := releaseAssignedOfficer(stub, lma)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := createKey(stub, prefixOfficerLMA, []string{officerID, lma.ApplicationID})
+	if err != nil {
+		return err
+	}
+	lma.AssignedOfficer = officerID
+	return stub.PutState(newKey, []byte{0x00})
+}
+
+// releaseAssignedOfficer takes the application off its officer's queue
+func releaseAssignedOfficer(stub shim.ChaincodeStubInterface, lma *LandMutationApplication) error {
+	if len(lma.AssignedOfficer) == 0 {
+		return nil
+	}
+	key, err := createKey(stub, prefixOfficerLMA, []string{lma.AssignedOfficer, lma.ApplicationID})
+	if err != nil {
+		return err
+	}
+	lma.AssignedOfficer = ""
+	return stub.DelState(key)
+}
+
+// moveLMAToStage hands the application on to the next stage, releasing the
+// officer of the current one. The next officer, if named, must hold the
+// stage's role; otherwise the application waits unassigned until a
+// supervisor assigns it or any officer of the role processes it. While the
+// citizen responds to the Estate Manager the officer stays assigned, as the
+// application returns to them. It returns an error response if the next
+// officer cannot take the application, nil otherwise.
+func moveLMAToStage(stub shim.ChaincodeStubInterface, lma *LandMutationApplication, stage string, nextOfficer string) *pb.Response {
+	lma.AssignTo = stage
+	if stage == "Citizen" {
+		return nil
+	}
+
+	if len(nextOfficer) == 0 {
+		err := releaseAssignedOfficer(stub, lma)
+		if err != nil {
+			return errorResponse(ledgerError(err))
+		}
+		return nil
+	}
+
+	officer, err := getOfficer(stub, nextOfficer)
+	if err != nil {
+		return errorResponse(ledgerError(err))
+	}
+	if officer == nil {
+		return errorResponse(lmaError(errCodeNotFound, "Officer does not exist.", "next_officer"))
+	}
+	if officer.Role != stage {
+		return errorResponse(lmaError(errCodeInvalidInput, "Next officer must hold the "+stage+" role.", "next_officer"))
+	}
+	err = setAssignedOfficer(stub, lma, officer.OfficerID)
+	if err != nil {
+		return errorResponse(ledgerError(err))
+	}
+	return nil
+}
+
+// authorizeLMAOfficer checks that the caller may act on the application at
+// its current stage: they must hold the stage's role and, once an officer is
+// assigned, be that officer or one the officer has delegated their queue to
+// today. It returns an error response if not, nil otherwise.
+func authorizeLMAOfficer(stub shim.ChaincodeStubInterface, lma LandMutationApplication, role string) *pb.Response {
+	err := assertCallerRole(stub, role)
+	if err != nil {
+		return errorResponse(lmaError(errCodeUnauthorized, err.Error(), ""))
+	}
+	if len(lma.AssignedOfficer) == 0 {
+		return nil
+	}
+
+	officerID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return errorResponse(lmaError(errCodeUnauthorized, err.Error(), ""))
+	}
+	if officerID == lma.AssignedOfficer {
+		return nil
+	}
+	delegated, err := hasActiveDelegation(stub, lma.AssignedOfficer, officerID)
+	if err != nil {
+		return errorResponse(ledgerError(err))
+	}
+	if !delegated {
+		return errorResponse(lmaError(errCodeUnauthorized, "Application is assigned to officer "+lma.AssignedOfficer+".", "application_id"))
+	}
+	return nil
+}
+
+// activeDelegations returns the delegations to the delegate in force at the
+// time of the transaction, optionally narrowed to one delegating officer
+func activeDelegations(stub shim.ChaincodeStubInterface, delegateID string, officerID string) ([]Delegation, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	today := now.Format(dateLayout)
+
+	keyParts := []string{delegateID}
+	if len(officerID) > 0 {
+		keyParts = append(keyParts, officerID)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixDelegation, keyParts)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	delegations := []Delegation{}
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		delegation := Delegation{}
+		err = json.Unmarshal(kvResult.Value, &delegation)
+		if err != nil {
+			return nil, err
+		}
+		if delegation.FromDate <= today && today <= delegation.ToDate {
+			delegations = append(delegations, delegation)
+		}
+	}
+	return delegations, nil
+}
+
+// hasActiveDelegation reports whether the officer's queue is delegated to
+// the delegate today
+func hasActiveDelegation(stub shim.ChaincodeStubInterface, officerID string, delegateID string) (bool, error) {
+	delegations, err := activeDelegations(stub, delegateID, officerID)
+	if err != nil {
+		return false, err
+	}
+	return len(delegations) > 0, nil
+}
+
+func createOfficer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, "Supervisor")
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	officer := Officer{}
+	err = json.Unmarshal([]byte(args[0]), &officer)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(officer.OfficerID) == 0 {
+		return requiredError("id")
+	}
+	switch officer.Role {
+	case "Supervisor", "EstateManager", "CEO", "FinanceOfficer":
+	default:
+		return lmaError(errCodeInvalidInput, "Unknown officer role.", "role")
+	}
+
+	existing, err := getOfficer(stub, officer.OfficerID)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if existing != nil {
+		return lmaError(errCodeInvalidState, "Officer already exists.", "id")
+	}
+
+	key, err := createKey(stub, prefixOfficer, []string{officer.OfficerID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	officerBytes, err := json.Marshal(officer)
+	if err != nil {
+		return internalError(err)
+	}
+	err = stub.PutState(key, officerBytes)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// delegateLMAQueue lets the calling officer hand their queue to another
+// officer of the same role for a date range
+func delegateLMAQueue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	officerID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		DelegateID string `json:"delegate_id"`
+		FromDate   string `json:"from_date"`
+		ToDate     string `json:"to_date"`
+		Reason     string `json:"reason"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.DelegateID) == 0 {
+		return requiredError("delegate_id")
+	}
+	if len(input.Reason) == 0 {
+		return requiredError("reason")
+	}
+	fromDate, err := time.Parse(dateLayout, input.FromDate)
+	if err != nil {
+		return lmaError(errCodeInvalidInput, "Dates must be formatted as YYYY-MM-DD.", "from_date")
+	}
+	toDate, err := time.Parse(dateLayout, input.ToDate)
+	if err != nil {
+		return lmaError(errCodeInvalidInput, "Dates must be formatted as YYYY-MM-DD.", "to_date")
+	}
+	if toDate.Before(fromDate) {
+		return lmaError(errCodeInvalidInput, "to_date is before from_date.", "to_date")
+	}
+
+	officer, err := getOfficer(stub, officerID)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if officer == nil {
+		return lmaError(errCodeNotFound, "Officer does not exist.", "")
+	}
+	delegate, err := getOfficer(stub, input.DelegateID)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if delegate == nil {
+		return lmaError(errCodeNotFound, "Officer does not exist.", "delegate_id")
+	}
+	if delegate.Role != officer.Role {
+		return lmaError(errCodeInvalidInput, "Delegate must hold the same role.", "delegate_id")
+	}
+	if delegate.OfficerID == officer.OfficerID {
+		return lmaError(errCodeInvalidInput, "Cannot delegate to oneself.", "delegate_id")
+	}
+
+	delegation := Delegation{
+		DelegationID: stub.GetTxID(),
+		OfficerID:    officer.OfficerID,
+		DelegateID:   delegate.OfficerID,
+		Role:         officer.Role,
+		FromDate:     input.FromDate,
+		ToDate:       input.ToDate,
+		Reason:       input.Reason,
+	}
+	key, err := createKey(stub, prefixDelegation, []string{delegation.DelegateID, delegation.OfficerID, delegation.DelegationID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	delegationBytes, err := json.Marshal(delegation)
+	if err != nil {
+		return internalError(err)
+	}
+	err = stub.PutState(key, delegationBytes)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(delegationBytes)
+}
+
+// revokeDelegation ends a delegation before its to_date. It may be revoked
+// by the delegating officer or a supervisor.
+func revokeDelegation(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	callerID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		DelegationID string `json:"delegation_id"`
+		OfficerID    string `json:"officer_id"`
+		DelegateID   string `json:"delegate_id"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.DelegationID) == 0 {
+		return requiredError("delegation_id")
+	}
+	if len(input.DelegateID) == 0 {
+		return requiredError("delegate_id")
+	}
+	if len(input.OfficerID) == 0 {
+		input.OfficerID = callerID
+	}
+	if input.OfficerID != callerID {
+		err = assertCallerRole(stub, "Supervisor")
+		if err != nil {
+			return lmaError(errCodeUnauthorized, err.Error(), "officer_id")
+		}
+	}
+
+	key, err := createKey(stub, prefixDelegation, []string{input.DelegateID, input.OfficerID, input.DelegationID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	delegationBytes, err := stub.GetState(key)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if len(delegationBytes) == 0 {
+		return lmaError(errCodeNotFound, "Delegation does not exist.", "delegation_id")
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// listOfficerQueue returns the applications assigned to an officer (the
+// caller by default, other officers for supervisors only) together with
+// those of officers whose delegation to them is active today
+func listOfficerQueue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	input := struct {
+		OfficerID string `json:"officer_id"`
+	}{}
+	if len(args) == 1 {
+		err := json.Unmarshal([]byte(args[0]), &input)
+		if err != nil {
+			return inputError(err)
+		}
+	}
+	callerID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+	if len(input.OfficerID) == 0 {
+		input.OfficerID = callerID
+	}
+	// Only supervisors may look at another officer's queue
+	if input.OfficerID != callerID {
+		err = assertCallerRole(stub, "Supervisor")
+		if err != nil {
+			return lmaError(errCodeUnauthorized, err.Error(), "officer_id")
+		}
+	}
+
+	// Officers whose queue is served, starting with the officer's own
+	officerIDs := []string{input.OfficerID}
+	delegations, err := activeDelegations(stub, input.OfficerID, "")
+	if err != nil {
+		return ledgerError(err)
+	}
+	for _, delegation := range delegations {
+		officerIDs = append(officerIDs, delegation.OfficerID)
+	}
+
+	type queuedLMA struct {
+		*LandMutationApplication
+		DelegatedBy string `json:"delegated_by,omitempty"`
+	}
+	results := []queuedLMA{}
+	seen := map[string]bool{}
+	for _, officerID := range officerIDs {
+		if seen[officerID] {
+			continue
+		}
+		seen[officerID] = true
+
+		officer, err := getOfficer(stub, officerID)
+		if err != nil {
+			return ledgerError(err)
+		}
+		if officer == nil {
+			if officerID == input.OfficerID {
+				return lmaError(errCodeNotFound, "Officer does not exist.", "officer_id")
+			}
+			continue
+		}
+
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixOfficerLMA, []string{officerID})
+		if err != nil {
+			return ledgerError(err)
+		}
+		for resultsIterator.HasNext() {
+			kvResult, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return ledgerError(err)
+			}
+			_, keyParts, err := stub.SplitCompositeKey(kvResult.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return ledgerError(err)
+			}
+
+			lmaKey, err := createKey(stub, prefixLMA, []string{keyParts[1]})
+			if err != nil {
+				resultsIterator.Close()
+				return ledgerError(err)
+			}
+			lmaBytes, err := stub.GetState(lmaKey)
+			if err != nil {
+				resultsIterator.Close()
+				return ledgerError(err)
+			}
+			if len(lmaBytes) == 0 {
+				continue
+			}
+
+			result := queuedLMA{LandMutationApplication: &LandMutationApplication{}}
+			err = json.Unmarshal(lmaBytes, result.LandMutationApplication)
+			if err != nil {
+				resultsIterator.Close()
+				return internalError(err)
+			}
+			// The application has since moved on to another stage
+			if result.AssignTo != officer.Role || result.AssignedOfficer != officerID {
+				continue
+			}
+			if officerID != input.OfficerID {
+				result.DelegatedBy = officerID
+			}
+			results = append(results, result)
+		}
+		resultsIterator.Close()
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
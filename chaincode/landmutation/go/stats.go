@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Stats events recorded on application transitions. A resolved row is
+// recorded alongside each decision, in the month the application was
+// received, so that pending can be derived from the months of the range
+const (
+	statReceived  = "received"
+	statCompleted = "completed"
+	statRejected  = "rejected"
+	statResolved  = "resolved"
+)
+
+// monthLayout is the month format of the stats rows, it sorts lexically
+const monthLayout = "2006-01"
+
+// maxStatsMonths is the longest range of months query_lma_stats reads
+const maxStatsMonths = 60
+
+/* Define the LMAStats structure, the totals of one district, sub-division
+   and month as returned by query_lma_stats
+*/
+type LMAStats struct {
+	District    string `json:"district"`
+	SubDivision string `json:"sub_division"`
+	Month       string `json:"month"`
+
+	Received  int `json:"received"`
+	Completed int `json:"completed"`
+	Rejected  int `json:"rejected"`
+
+	// Completions with a known submission time and their total duration,
+	// used to derive the average time-to-complete
+	TimedCompletions  int   `json:"timed_completions"`
+	CompletionSeconds int64 `json:"completion_seconds"`
+}
+
+/* Define the LMAStatEvent structure, one row per application transition.
+   Rows are only ever written blindly, so transitions in the same district
+   and month do not conflict with each other. Rows are keyed month first so
+   that a query only reads the months it reports on. Key consist of
+   prefix + Month + District + SubDivision + TxID + ApplicationID + Event
+*/
+type LMAStatEvent struct {
+	ApplicationID string `json:"application_id"`
+	Event         string `json:"event"`
+
+	// Month the application was received in, empty for applications
+	// seeded by init_ledger which carry no submission time
+	ReceivedMonth string `json:"received_month"`
+
+	// Time from submission to completion, set on timed completions only
+	CompletionSeconds *int64 `json:"completion_seconds,omitempty"`
+}
+
+// recordLMAStat records a transition of the application against its
+// district and sub-division for the month of the current transaction.
+// Decisions on applications with a known submission time also record a
+// resolved row in the month the application was received.
+func recordLMAStat(stub shim.ChaincodeStubInterface, lma LandMutationApplication, event string) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+
+	statEvent := LMAStatEvent{ApplicationID: lma.ApplicationID, Event: event}
+	submittedOn, err := time.Parse(time.RFC3339, lma.SubmittedOn)
+	if err == nil {
+		statEvent.ReceivedMonth = submittedOn.UTC().Format(monthLayout)
+		if event == statCompleted {
+			completionSeconds := int64(now.Sub(submittedOn).Seconds())
+			statEvent.CompletionSeconds = &completionSeconds
+		}
+	}
+	err = putLMAStatEvent(stub, lma, now.Format(monthLayout), statEvent)
+	if err != nil {
+		return err
+	}
+
+	if event == statReceived || len(statEvent.ReceivedMonth) == 0 {
+		return nil
+	}
+	resolved := LMAStatEvent{ApplicationID: lma.ApplicationID, Event: statResolved, ReceivedMonth: statEvent.ReceivedMonth}
+	return putLMAStatEvent(stub, lma, statEvent.ReceivedMonth, resolved)
+}
+
+// putLMAStatEvent blindly writes a stats row of the application's district
+// and sub-division for a month
+func putLMAStatEvent(stub shim.ChaincodeStubInterface, lma LandMutationApplication, month string, statEvent LMAStatEvent) error {
+	key, err := createKey(stub, prefixLMAStats, []string{month, lma.District, lma.SubDivision, stub.GetTxID(), lma.ApplicationID, statEvent.Event})
+	if err != nil {
+		return err
+	}
+
+	statBytes, err := json.Marshal(statEvent)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, statBytes)
+}
+
+// queryLMAStats adds up the transitions of a district (optionally narrowed
+// to a sub-division) over an inclusive range of at most maxStatsMonths
+// months, reading only the rows of those months. The range defaults to the
+// month of the transaction. Received is counted in the month of submission,
+// completed and rejected in the month of the decision. Pending counts the
+// applications received within the range that have been neither completed
+// nor rejected since, whenever that happened.
+func queryLMAStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return argCountError()
+	}
+
+	input := struct {
+		District    string `json:"district"`
+		SubDivision string `json:"sub_division"`
+		FromMonth   string `json:"from_month"`
+		ToMonth     string `json:"to_month"`
+	}{}
+	if len(args) == 1 {
+		err := json.Unmarshal([]byte(args[0]), &input)
+		if err != nil {
+			return inputError(err)
+		}
+	}
+	if len(input.SubDivision) > 0 && len(input.District) == 0 {
+		return lmaError(errCodeInvalidInput, "sub_division requires a district.", "sub_division")
+	}
+	if len(input.ToMonth) == 0 {
+		now, err := txTime(stub)
+		if err != nil {
+			return ledgerError(err)
+		}
+		input.ToMonth = now.Format(monthLayout)
+	}
+	if len(input.FromMonth) == 0 {
+		input.FromMonth = input.ToMonth
+	}
+	fromMonth, err := time.Parse(monthLayout, input.FromMonth)
+	if err != nil {
+		return lmaError(errCodeInvalidInput, "Months must be formatted as YYYY-MM.", "from_month")
+	}
+	toMonth, err := time.Parse(monthLayout, input.ToMonth)
+	if err != nil {
+		return lmaError(errCodeInvalidInput, "Months must be formatted as YYYY-MM.", "to_month")
+	}
+	if toMonth.Before(fromMonth) {
+		return lmaError(errCodeInvalidInput, "to_month must not be before from_month.", "to_month")
+	}
+	if !toMonth.Before(fromMonth.AddDate(0, maxStatsMonths, 0)) {
+		return lmaError(errCodeInvalidInput, fmt.Sprintf("The range must not exceed %d months.", maxStatsMonths), "to_month")
+	}
+
+	response := struct {
+		District              string     `json:"district"`
+		SubDivision           string     `json:"sub_division"`
+		FromMonth             string     `json:"from_month"`
+		ToMonth               string     `json:"to_month"`
+		Received              int        `json:"received"`
+		Completed             int        `json:"completed"`
+		Rejected              int        `json:"rejected"`
+		Pending               int        `json:"pending"`
+		AverageDaysToComplete float64    `json:"average_days_to_complete"`
+		Breakdown             []LMAStats `json:"breakdown"`
+	}{
+		District:    input.District,
+		SubDivision: input.SubDivision,
+		FromMonth:   input.FromMonth,
+		ToMonth:     input.ToMonth,
+		Breakdown:   []LMAStats{},
+	}
+
+	timedCompletions := 0
+	var completionSeconds int64
+	resolved := 0
+	for month := fromMonth; !month.After(toMonth); month = month.AddDate(0, 1, 0) {
+		keyParts := []string{month.Format(monthLayout)}
+		if len(input.District) > 0 {
+			keyParts = append(keyParts, input.District)
+			if len(input.SubDivision) > 0 {
+				keyParts = append(keyParts, input.SubDivision)
+			}
+		}
+		errResponse := addLMAStats(stub, keyParts, &response.Breakdown, &resolved)
+		if errResponse != nil {
+			return *errResponse
+		}
+	}
+
+	for _, stats := range response.Breakdown {
+		response.Received += stats.Received
+		response.Completed += stats.Completed
+		response.Rejected += stats.Rejected
+		timedCompletions += stats.TimedCompletions
+		completionSeconds += stats.CompletionSeconds
+	}
+	response.Pending = response.Received - resolved
+	if timedCompletions > 0 {
+		response.AverageDaysToComplete = float64(completionSeconds) / float64(timedCompletions) / (24 * 60 * 60)
+	}
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(responseBytes)
+}
+
+// addLMAStats adds the stats rows of one month, optionally narrowed to a
+// district and sub-division, to the breakdown and counts its resolved rows
+func addLMAStats(stub shim.ChaincodeStubInterface, keyParts []string, breakdown *[]LMAStats, resolved *int) *pb.Response {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixLMAStats, keyParts)
+	if err != nil {
+		return errorResponse(ledgerError(err))
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(ledgerError(err))
+		}
+		_, keyParts, err := stub.SplitCompositeKey(kvResult.Key)
+		if err != nil {
+			return errorResponse(ledgerError(err))
+		}
+		if len(keyParts) < 3 {
+			continue
+		}
+
+		statEvent := LMAStatEvent{}
+		err = json.Unmarshal(kvResult.Value, &statEvent)
+		if err != nil {
+			return errorResponse(internalError(err))
+		}
+		if statEvent.Event == statResolved {
+			*resolved++
+			continue
+		}
+
+		// Rows are sorted by month, district and sub-division, so each
+		// breakdown entry is built from consecutive rows
+		month, district, subDivision := keyParts[0], keyParts[1], keyParts[2]
+		last := len(*breakdown) - 1
+		if last < 0 || (*breakdown)[last].District != district ||
+			(*breakdown)[last].SubDivision != subDivision || (*breakdown)[last].Month != month {
+			*breakdown = append(*breakdown, LMAStats{District: district, SubDivision: subDivision, Month: month})
+			last++
+		}
+		stats := &(*breakdown)[last]
+
+		switch statEvent.Event {
+		case statReceived:
+			stats.Received++
+		case statRejected:
+			stats.Rejected++
+		case statCompleted:
+			stats.Completed++
+			if statEvent.CompletionSeconds != nil {
+				stats.TimedCompletions++
+				stats.CompletionSeconds += *statEvent.CompletionSeconds
+			}
+		}
+	}
+	return nil
+}
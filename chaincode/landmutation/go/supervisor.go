@@ -18,45 +18,175 @@ type Supervisor struct {
 
 func processLMASupervisor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Invalid Arguments Count.")
+		return argCountError()
 	}
 
 	input := struct {
 		ApplicationID     string `json:"application_id"`
 		SupervisorComment string `json:"comment"`
+		NextOfficer       string `json:"next_officer"`
 	}{}
 	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
 
 	// Comment code
 	supervisorComment := []string{input.SupervisorComment}
 	supervisorComment = append(supervisorComment, "true")
 
-	lmaKey, err := stub.CreateCompositeKey(prefixLMA, []string{input.ApplicationID})
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	lmaKey, err := createKey(stub, prefixLMA, []string{input.ApplicationID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
 	}
 
-	lmaBytes, _ := stub.GetState(lmaKey)
+	lmaBytes, err := stub.GetState(lmaKey)
+	if err != nil {
+		return ledgerError(err)
+	}
 	if len(lmaBytes) == 0 {
-		return shim.Error("Land Mutation Application ID does not exist")
+		return lmaNotFoundError()
 	}
 
 	lma := LandMutationApplication{}
 	err = json.Unmarshal(lmaBytes, &lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 
-	lma.AssignTo = "EstateManager"
+	errResponse := authorizeLMAOfficer(stub, lma, "Supervisor")
+	if errResponse != nil {
+		return *errResponse
+	}
+	errResponse = moveLMAToStage(stub, &lma, "EstateManager", input.NextOfficer)
+	if errResponse != nil {
+		return *errResponse
+	}
 	lma.Status = "Inprogress"
 
 	lmaBytes, err = json.Marshal(lma)
 	if err != nil {
-		return shim.Error(err.Error())
+		return internalError(err)
 	}
 	err = stub.PutState(lmaKey, lmaBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return ledgerError(err)
+	}
+
+	return shim.Success(nil)
+}
+
+// reassignLMA moves applications between officers of the same role, e.g.
+// when the assigned officer is on leave
+func reassignLMA(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	err := assertCallerRole(stub, "Supervisor")
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+	supervisorID, err := resolveCallerOfficerID(stub)
+	if err != nil {
+		return lmaError(errCodeUnauthorized, err.Error(), "")
+	}
+
+	input := struct {
+		ApplicationIDs []string `json:"application_ids"`
+		FromOfficer    string   `json:"from_officer"`
+		ToOfficer      string   `json:"to_officer"`
+		Reason         string   `json:"reason"`
+	}{}
+	err = json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.ApplicationIDs) == 0 {
+		return requiredError("application_ids")
+	}
+	if len(input.ToOfficer) == 0 {
+		return requiredError("to_officer")
+	}
+	if len(input.Reason) == 0 {
+		return requiredError("reason")
+	}
+
+	toOfficer, err := getOfficer(stub, input.ToOfficer)
+	if err != nil {
+		return ledgerError(err)
+	}
+	if toOfficer == nil {
+		return lmaError(errCodeNotFound, "Officer does not exist.", "to_officer")
+	}
+	if len(input.FromOfficer) > 0 {
+		fromOfficer, err := getOfficer(stub, input.FromOfficer)
+		if err != nil {
+			return ledgerError(err)
+		}
+		if fromOfficer == nil {
+			return lmaError(errCodeNotFound, "Officer does not exist.", "from_officer")
+		}
+		if fromOfficer.Role != toOfficer.Role {
+			return lmaError(errCodeInvalidInput, "Officers must hold the same role.", "to_officer")
+		}
+	}
+
+	for _, applicationID := range input.ApplicationIDs {
+		lmaKey, err := createKey(stub, prefixLMA, []string{applicationID})
+		if err != nil {
+			return ledgerError(err)
+		}
+		lmaBytes, err := stub.GetState(lmaKey)
+		if err != nil {
+			return ledgerError(err)
+		}
+		if len(lmaBytes) == 0 {
+			return lmaError(errCodeNotFound, "Land Mutation Application ID does not exist: "+applicationID, "application_ids")
+		}
+
+		lma := LandMutationApplication{}
+		err = json.Unmarshal(lmaBytes, &lma)
+		if err != nil {
+			return internalError(err)
+		}
+		if lma.AssignTo != toOfficer.Role {
+			return lmaError(errCodeInvalidState, "Application "+applicationID+" is not assigned to "+toOfficer.Role, "application_ids")
+		}
+		if len(input.FromOfficer) > 0 && lma.AssignedOfficer != input.FromOfficer {
+			return lmaError(errCodeInvalidState, "Application "+applicationID+" is not assigned to "+input.FromOfficer, "application_ids")
+		}
+
+		previousOfficer := lma.AssignedOfficer
+		err = setAssignedOfficer(stub, &lma, toOfficer.OfficerID)
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		lmaBytes, err = json.Marshal(lma)
+		if err != nil {
+			return internalError(err)
+		}
+		err = stub.PutState(lmaKey, lmaBytes)
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		err = appendLMATrail(stub, LMATrailEntry{
+			ApplicationID: applicationID,
+			Action:        "Reassigned",
+			Actor:         supervisorID,
+			From:          previousOfficer,
+			To:            toOfficer.OfficerID,
+			Reason:        input.Reason,
+		})
+		if err != nil {
+			return ledgerError(err)
+		}
 	}
 
 	return shim.Success(nil)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+/* Define the LMATrailEntry structure, one audited action on an application.
+   Key consist of
+   prefix + ApplicationID + TxID
+*/
+type LMATrailEntry struct {
+	ApplicationID string `json:"application_id"`
+	TxID          string `json:"tx_id"`
+	Timestamp     string `json:"timestamp"`
+	Action        string `json:"action"`
+	Actor         string `json:"actor"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	Reason        string `json:"reason"`
+}
+
+// appendLMATrail records an action against the application, stamped with
+// the current transaction
+func appendLMATrail(stub shim.ChaincodeStubInterface, entry LMATrailEntry) error {
+	now, err := txTime(stub)
+	if err != nil {
+		return err
+	}
+	entry.TxID = stub.GetTxID()
+	entry.Timestamp = now.Format(time.RFC3339)
+
+	key, err := createKey(stub, prefixLMATrail, []string{entry.ApplicationID, entry.TxID})
+	if err != nil {
+		return err
+	}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, entryBytes)
+}
+
+func listLMATrail(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return argCountError()
+	}
+
+	input := struct {
+		ApplicationID string `json:"application_id"`
+	}{}
+	err := json.Unmarshal([]byte(args[0]), &input)
+	if err != nil {
+		return inputError(err)
+	}
+	if len(input.ApplicationID) == 0 {
+		return requiredError("application_id")
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(prefixLMATrail, []string{input.ApplicationID})
+	if err != nil {
+		return ledgerError(err)
+	}
+	defer resultsIterator.Close()
+
+	results := []LMATrailEntry{}
+	for resultsIterator.HasNext() {
+		kvResult, err := resultsIterator.Next()
+		if err != nil {
+			return ledgerError(err)
+		}
+
+		entry := LMATrailEntry{}
+		err = json.Unmarshal(kvResult.Value, &entry)
+		if err != nil {
+			return internalError(err)
+		}
+		results = append(results, entry)
+	}
+	// Keys are ordered by TxID, present the trail in time order instead
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Timestamp < results[j].Timestamp
+	})
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return internalError(err)
+	}
+	return shim.Success(resultsAsBytes)
+}
@@ -0,0 +1,181 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Deleting and restoring marbles ====
+// delete archives a marble: it stays in state, marked with who deleted it, when and why, but is
+// removed from the color~name, owner~name and size~name indexes and left out of range and rich
+// queries, and can no longer be transferred, updated or offered. restoreMarble undoes this and
+// indexes the marble again. purgeMarble removes a marble from state for good, as delete used to,
+// and is only available to admins. The name of a deleted marble stays taken until it is purged.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type archive struct {
+	DeletedBy string `json:"deletedBy"` //identity of the caller which deleted the marble
+	DeletedAt string `json:"deletedAt"` //RFC 3339
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ===========================================================================================
+// newArchive records that the caller deleted a marble in this transaction
+// ===========================================================================================
+func newArchive(stub shim.ChaincodeStubInterface, reason string) (*archive, error) {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get transaction timestamp: %s", err.Error())
+	}
+	return &archive{caller, now.Format(time.RFC3339), reason}, nil
+}
+
+// ===========================================================================================
+// checkNotArchived returns an error if the marble has been deleted
+// ===========================================================================================
+func checkNotArchived(marbleJSON *marble) error {
+	if marbleJSON.Archived != nil {
+		return fmt.Errorf("Marble %s was deleted by %s at %s", marbleJSON.Name, marbleJSON.Archived.DeletedBy, marbleJSON.Archived.DeletedAt)
+	}
+	return nil
+}
+
+// ===========================================================================================
+// isArchived reports whether a value read from state is a deleted marble
+// ===========================================================================================
+func isArchived(value []byte) bool {
+	archived := struct {
+		Archived *archive `json:"archived"`
+	}{}
+	err := json.Unmarshal(value, &archived)
+	return err == nil && archived.Archived != nil
+}
+
+// ==============================================================
+// restoreMarble - restore a deleted marble and index it again
+// ==============================================================
+func (t *SimpleChaincode) restoreMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	fmt.Println("- start restoreMarble ", marbleName)
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToRestore := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToRestore.Archived == nil {
+		return shim.Error("Marble " + marbleName + " has not been deleted")
+	}
+
+	// only the owner may restore the marble
+	err = checkOwner(stub, &marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marbleToRestore.Archived = nil
+	marbleJSONasBytes, err := json.Marshal(marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// index the marble again
+	err = putIndexEntry(stub, "color~name", []string{marbleToRestore.Color, marbleToRestore.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = indexMarble(stub, &marbleToRestore)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end restoreMarble (success)")
+	return shim.Success(nil)
+}
+
+// ==================================================================================
+// purgeMarble - remove a marble key/value pair from state, deleted or not. Admin only.
+// ==================================================================================
+func (t *SimpleChaincode) purgeMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	fmt.Println("- start purgeMarble ", marbleName)
+
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only an admin may purge a marble")
+	}
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToPurge := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToPurge)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = stub.DelState(marbleName) //remove the marble from chaincode state
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+
+	// a purged marble is no longer locked
+	if marbleToPurge.Lock != nil {
+		err = delIndexEntry(stub, lockIndex, []string{marbleToPurge.Lock.Holder, marbleName})
+		if err != nil {
+			return shim.Error("Failed to delete state:" + err.Error())
+		}
+	}
+
+	// a deleted marble has already been removed from the indexes
+	if marbleToPurge.Archived == nil {
+		err = removeFromIndexes(stub, &marbleToPurge)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	fmt.Println("- end purgeMarble (success)")
+	return shim.Success(nil)
+}
@@ -0,0 +1,263 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Bulk operations ====
+// initMarbles creates several marbles in one transaction, and transferMarblesBasedOnOwner and
+// transferMarblesBasedOnColorWithPagination move an owner's or a color's marbles to a new owner.
+// initMarbles is all-or-nothing: if any marble fails, the transaction returns an error and none of
+// its writes are committed. The transfers instead skip the marbles the caller may not transfer,
+// such as locked marbles or marbles of another owner, and list them in their result. To keep
+// transactions to a reasonable size, each handles at most maxBatchSize marbles; the transfers
+// return a bookmark from which to continue when there are more.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type marbleInit struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+	Size  int    `json:"size"`
+	Owner string `json:"owner"`
+}
+
+type skippedMarble struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type bulkTransferResult struct {
+	Transferred int             `json:"transferred"`
+	Skipped     []skippedMarble `json:"skipped,omitempty"` //marbles the caller may not transfer, left as they were
+	Bookmark    string          `json:"bookmark"`          //name of the next marble to transfer, empty once all have been
+}
+
+// ===================================================================================
+// initMarbles - create several marbles in one transaction, all or nothing
+// ===================================================================================
+func (t *SimpleChaincode) initMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// '[{"name":"marble1","color":"blue","size":35,"owner":"tom"}, ...]'
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	var marbles []marbleInit
+	err := json.Unmarshal([]byte(args[0]), &marbles)
+	if err != nil {
+		return shim.Error("1st argument must be a JSON array of marbles: " + err.Error())
+	}
+	if len(marbles) == 0 || len(marbles) > maxBatchSize {
+		return shim.Error(fmt.Sprintf("Expecting between 1 and %d marbles", maxBatchSize))
+	}
+	fmt.Println("- start initMarbles ", len(marbles))
+
+	// a marble written earlier in this transaction cannot be read back, so catch duplicates here
+	names := map[string]bool{}
+	for i, m := range marbles {
+		if names[m.Name] {
+			return shim.Error(fmt.Sprintf("Marble %d: marble %s is listed more than once", i, m.Name))
+		}
+		names[m.Name] = true
+
+		// Re-use the same function that is used to create individual marbles, which validates the marble
+		response := t.initMarble(stub, []string{m.Name, m.Color, strconv.Itoa(m.Size), m.Owner})
+		if response.Status != shim.OK {
+			return shim.Error(fmt.Sprintf("Marble %d: %s", i, response.Message))
+		}
+	}
+
+	fmt.Println("- end initMarbles (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// parseBulkTransferArgs parses the arguments shared by the bulk transfers, which take the
+// attribute to select marbles by, the new owner name and identity, and optionally a limit and
+// a bookmark. The attribute is returned as given, since owner identities are case sensitive.
+// ===========================================================================================
+func parseBulkTransferArgs(args []string) (string, string, string, int, string, error) {
+	if len(args) < 3 || len(args) > 5 {
+		return "", "", "", 0, "", fmt.Errorf("Incorrect number of arguments. Expecting 3 to 5")
+	}
+	if len(args[2]) <= 0 {
+		return "", "", "", 0, "", fmt.Errorf("3rd argument must be a non-empty string")
+	}
+
+	limit := maxBatchSize
+	if len(args) > 3 && len(args[3]) > 0 {
+		var err error
+		limit, err = strconv.Atoi(args[3])
+		if err != nil || limit <= 0 || limit > maxBatchSize {
+			return "", "", "", 0, "", fmt.Errorf("4th argument must be a numeric string between 1 and %d", maxBatchSize)
+		}
+	}
+	bookmark := ""
+	if len(args) > 4 {
+		bookmark = args[4]
+	}
+	return args[0], strings.ToLower(args[1]), args[2], limit, bookmark, nil
+}
+
+// ===========================================================================================
+// transferMarblesFromIndex transfers up to limit of the marbles under an index entry to a new
+// owner, starting from the marble named by bookmark. Marbles that are deleted, locked or not the
+// caller's to transfer are skipped and listed in the result, and count towards limit so that
+// every call moves the bookmark forward. If more marbles remain, the name of the next one is
+// returned as the bookmark.
+//
+// Paginated queries are only valid for read only transactions, and GetStateByRange does not
+// accept composite keys, so the index is read from its start with GetStateByPartialCompositeKey
+// and the entries before the bookmark are passed over. Only their keys are read, but each page
+// reads every entry before it again, so walking all n entries of an index a page at a time reads
+// on the order of n*n/limit keys in total, with limit at most maxBatchSize.
+// ===========================================================================================
+func (t *SimpleChaincode) transferMarblesFromIndex(stub shim.ChaincodeStubInterface, indexName string, attribute string, newOwner string, newOwnerID string, limit int, bookmark string) (*bulkTransferResult, error) {
+	// This will execute a key range query on all keys starting with the attribute
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{attribute})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	// Iterate through result set and for each marble found, transfer to newOwner
+	result := &bulkTransferResult{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		// get the marble name from the composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		returnedMarbleName := compositeKeyParts[1]
+		if returnedMarbleName < bookmark {
+			continue
+		}
+		if result.Transferred+len(result.Skipped) == limit {
+			result.Bookmark = returnedMarbleName
+			break
+		}
+
+		marbleAsBytes, err := stub.GetState(returnedMarbleName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get marble:%s", err.Error())
+		} else if marbleAsBytes == nil {
+			return nil, fmt.Errorf("Marble %s does not exist", returnedMarbleName)
+		}
+		marbleToTransfer := marble{}
+		err = json.Unmarshal(marbleAsBytes, &marbleToTransfer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Run the checks of transferMarble up front, as an error from it would fail the whole transaction
+		err = checkTransferable(stub, &marbleToTransfer)
+		if err != nil {
+			result.Skipped = append(result.Skipped, skippedMarble{returnedMarbleName, err.Error()})
+			continue
+		}
+		err = changeOwner(stub, &marbleToTransfer, newOwner, newOwnerID)
+		if err != nil {
+			return nil, err
+		}
+		result.Transferred++
+	}
+	return result, nil
+}
+
+// ===========================================================================================
+// checkTransferable returns an error if the caller may not transfer the marble, because it is
+// deleted, locked, or neither the caller's nor the caller an admin
+// ===========================================================================================
+func checkTransferable(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
+	err := checkNotArchived(marbleJSON)
+	if err != nil {
+		return err
+	}
+	err = checkNotLocked(marbleJSON)
+	if err != nil {
+		return err
+	}
+	return checkOwner(stub, marbleJSON) //only the owner may transfer the marble
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery =========================================
+// transferMarblesBasedOnOwner will transfer the marbles of a given owner identity to a new owner,
+// like transferMarblesBasedOnColor, using the owner~name index. At most limit marbles are transferred
+// or skipped, maxBatchSize by default; if the owner has more, the name of the next one is returned
+// as a bookmark to pass to the next call. Locked marbles are skipped and listed in the response.
+// ===========================================================================================
+func (t *SimpleChaincode) transferMarblesBasedOnOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0                               1        2                                 3     4
+	// "Org1MSP/tom@org1.example.com", "jerry", "Org1MSP/jerry@org1.example.com", "10", "marble5"   - limit and bookmark are optional
+	owner, newOwner, newOwnerID, limit, bookmark, err := parseBulkTransferArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if owner == newOwnerID {
+		return shim.Error("The marbles of " + owner + " already belong to " + newOwnerID)
+	}
+	fmt.Println("- start transferMarblesBasedOnOwner ", owner, newOwner, newOwnerID, limit, bookmark)
+
+	// Query the owner~name index by owner
+	result, err := t.transferMarblesFromIndex(stub, ownerIndex, owner, newOwner, newOwnerID, limit, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferMarblesBasedOnOwner: " + string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+}
+
+// ==== Example: GetStateByPartialCompositeKey/RangeQuery in pages ================================
+// transferMarblesBasedOnColorWithPagination will transfer marbles of a given color to a new owner
+// like transferMarblesBasedOnColor, but at most limit of them per call, maxBatchSize by default,
+// so that colors with many marbles do not exceed the limits of a single transaction. The
+// response holds the number transferred, the marbles skipped because the caller may not transfer
+// them, and a bookmark; callers pass the bookmark to the next call until it is empty.
+// ===========================================================================================
+func (t *SimpleChaincode) transferMarblesBasedOnColorWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1        2                                 3     4
+	// "blue", "jerry", "Org1MSP/jerry@org1.example.com", "10", "marble5"   - limit and bookmark are optional
+	color, newOwner, newOwnerID, limit, bookmark, err := parseBulkTransferArgs(args)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	color = strings.ToLower(color)
+	fmt.Println("- start transferMarblesBasedOnColorWithPagination ", color, newOwner, newOwnerID, limit, bookmark)
+
+	// Query the color~name index by color
+	result, err := t.transferMarblesFromIndex(stub, "color~name", color, newOwner, newOwnerID, limit, bookmark)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end transferMarblesBasedOnColorWithPagination: " + string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+}
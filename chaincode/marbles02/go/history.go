@@ -0,0 +1,148 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Marble history ====
+// getHistoryForMarble returns the versions of a marble, oldest first, as a JSON array of
+// historyRecord. It can be limited to the versions written since a time, and to a number of
+// versions. In diff mode every record also lists the fields which changed from the version
+// before it, whether or not that version was returned.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+type historyRecord struct {
+	TxID      string          `json:"txId"`
+	Value     json.RawMessage `json:"value"`     //the marble as written, null if it was deleted
+	Timestamp string          `json:"timestamp"` //RFC 3339
+	IsDelete  bool            `json:"isDelete"`
+	Changes   []fieldChange   `json:"changes,omitempty"` //diff mode only
+}
+
+type fieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"` //null if the field was not set
+	To    interface{} `json:"to"`   //null if the field was removed or the marble deleted
+}
+
+// ===========================================================================================
+// diffFields lists the fields which differ between two versions of a marble, in order of name.
+// A nil version, i.e. before the marble was created or after it was deleted, has no fields.
+// ===========================================================================================
+func diffFields(from map[string]interface{}, to map[string]interface{}) []fieldChange {
+	fields := []string{}
+	for field := range from {
+		fields = append(fields, field)
+	}
+	for field := range to {
+		if _, ok := from[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []fieldChange{}
+	for _, field := range fields {
+		if !reflect.DeepEqual(from[field], to[field]) {
+			changes = append(changes, fieldChange{field, from[field], to[field]})
+		}
+	}
+	return changes
+}
+
+// ===========================================================================================
+// getHistoryForMarble returns the history of a marble, optionally limited and diffed
+// ===========================================================================================
+func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1     2                        3
+	// "marble1", "10", "2019-01-01T00:00:00Z", "diff"   - all but the name are optional and may be empty
+	if len(args) < 1 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 to 4")
+	}
+
+	marbleName := args[0]
+	limit := 0
+	if len(args) > 1 && len(args[1]) > 0 {
+		var err error
+		limit, err = strconv.Atoi(args[1])
+		if err != nil || limit < 0 {
+			return shim.Error("2nd argument must be a non-negative numeric string")
+		}
+	}
+	var since time.Time
+	if len(args) > 2 && len(args[2]) > 0 {
+		var err error
+		since, err = time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return shim.Error("3rd argument must be an RFC 3339 time")
+		}
+	}
+	diff := false
+	if len(args) > 3 && len(args[3]) > 0 {
+		if args[3] != "diff" {
+			return shim.Error("4th argument must be diff or empty")
+		}
+		diff = true
+	}
+
+	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
+
+	resultsIterator, err := stub.GetHistoryForKey(marbleName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	records := []historyRecord{}
+	var previous map[string]interface{}
+	for resultsIterator.HasNext() && (limit == 0 || len(records) < limit) {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// if it was a delete operation on given key, then the value is null
+		record := historyRecord{TxID: response.TxId, IsDelete: response.IsDelete, Value: json.RawMessage("null")}
+		if !response.IsDelete {
+			record.Value = response.Value
+		}
+		timestamp := time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).UTC()
+		record.Timestamp = timestamp.Format(time.RFC3339Nano)
+
+		var current map[string]interface{}
+		if diff {
+			err = json.Unmarshal(record.Value, &current)
+			if err != nil {
+				return shim.Error("Failed to decode version " + response.TxId + " of " + marbleName + ": " + err.Error())
+			}
+			record.Changes = diffFields(previous, current)
+		}
+		previous = current
+
+		if timestamp.Before(since) {
+			continue
+		}
+		records = append(records, record)
+	}
+
+	recordsAsBytes, err := json.Marshal(records)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- getHistoryForMarble returning:\n%s\n", string(recordsAsBytes))
+
+	return shim.Success(recordsAsBytes)
+}
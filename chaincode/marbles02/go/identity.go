@@ -0,0 +1,76 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// adminAttribute is the certificate attribute which, set to "true", lets its holder act on any marble
+const adminAttribute = "marbles.admin"
+
+// ===========================================================================================
+// callerIdentity returns the identity of the invoking client qualified by its MSP, e.g.
+// Org1MSP/User1@org1.example.com. This is the identity recorded as the owner of a marble.
+// Clients without an X.509 certificate are identified by their unique client ID instead.
+// ===========================================================================================
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the MSP of the caller: %s", err.Error())
+	}
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the certificate of the caller: %s", err.Error())
+	}
+	if cert != nil && cert.Subject.CommonName != "" {
+		return mspID + "/" + cert.Subject.CommonName, nil
+	}
+
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get the ID of the caller: %s", err.Error())
+	}
+	return mspID + "/" + id, nil
+}
+
+// ===========================================================================================
+// isAdmin reports whether the caller holds the admin attribute
+// ===========================================================================================
+func isAdmin(stub shim.ChaincodeStubInterface) (bool, error) {
+	value, found, err := cid.GetAttributeValue(stub, adminAttribute)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get the attributes of the caller: %s", err.Error())
+	}
+	return found && value == "true", nil
+}
+
+// ===========================================================================================
+// checkOwner returns an error unless the caller is the owner of the marble or an admin.
+// Marbles created before owners were recorded can only be changed by an admin.
+// ===========================================================================================
+func checkOwner(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	if marbleJSON.OwnerID != "" && caller == marbleJSON.OwnerID {
+		return nil
+	}
+
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return err
+	}
+	if admin {
+		return nil
+	}
+
+	return fmt.Errorf("%s is not the owner of marble %s", caller, marbleJSON.Name)
+}
@@ -0,0 +1,301 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Owner and size indexes ====
+// Besides the color~name index, every marble is indexed by owner~name and size~name so that it
+// can be found by owner or size with range queries, which unlike rich queries work on LevelDB and
+// are re-executed at commit time. The owner~name keys hold the owner's identity, see callerIdentity,
+// rather than the owner name, a free-text label that several identities may share. Sizes are
+// zero-padded in the size~name keys so that the keys sort in numeric order. Marbles created before
+// these indexes were introduced are indexed once they are transferred, or by an admin with
+// reindexMarbles.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const ownerIndex = "owner~name"
+const sizeIndex = "size~name"
+
+// maxBatchSize is the largest number of marbles a bulk operation handles in one transaction
+const maxBatchSize = 100
+
+// sizeKey pads a size to the 19 digits of the largest int so that sizes sort numerically
+func sizeKey(size int) string {
+	return fmt.Sprintf("%019d", size)
+}
+
+// ===========================================================================================
+// putIndexEntry saves an index entry for a marble. As with the color~name index, only the key is
+// needed and the value is a null character.
+// ===========================================================================================
+func putIndexEntry(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+// ===========================================================================================
+// delIndexEntry deletes an index entry of a marble
+// ===========================================================================================
+func delIndexEntry(stub shim.ChaincodeStubInterface, indexName string, attributes []string) error {
+	indexKey, err := stub.CreateCompositeKey(indexName, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(indexKey)
+}
+
+// ===========================================================================================
+// indexMarble saves the owner~name and size~name index entries of a marble. Marbles with no
+// recorded owner identity are only indexed by size.
+// ===========================================================================================
+func indexMarble(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
+	if marbleJSON.OwnerID != "" {
+		err := putIndexEntry(stub, ownerIndex, []string{marbleJSON.OwnerID, marbleJSON.Name})
+		if err != nil {
+			return err
+		}
+	}
+	return putIndexEntry(stub, sizeIndex, []string{sizeKey(marbleJSON.Size), marbleJSON.Name})
+}
+
+// ===========================================================================================
+// unindexMarble deletes the owner~name and size~name index entries of a marble
+// ===========================================================================================
+func unindexMarble(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
+	if marbleJSON.OwnerID != "" {
+		err := delIndexEntry(stub, ownerIndex, []string{marbleJSON.OwnerID, marbleJSON.Name})
+		if err != nil {
+			return err
+		}
+	}
+	return delIndexEntry(stub, sizeIndex, []string{sizeKey(marbleJSON.Size), marbleJSON.Name})
+}
+
+// ===========================================================================================
+// addMarbleToResponse appends a marble found through an index to a JSON array of query results,
+// in the same format as constructQueryResponseFromIterator
+// ===========================================================================================
+func addMarbleToResponse(stub shim.ChaincodeStubInterface, buffer *bytes.Buffer, marbleName string) error {
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return err
+	} else if marbleAsBytes == nil {
+		return fmt.Errorf("Marble %s is indexed but does not exist", marbleName)
+	}
+
+	// Add a comma before array members, suppress it for the first array member
+	if buffer.Len() > 1 {
+		buffer.WriteString(",")
+	}
+	buffer.WriteString("{\"Key\":")
+	buffer.WriteString("\"")
+	buffer.WriteString(marbleName)
+	buffer.WriteString("\"")
+
+	buffer.WriteString(", \"Record\":")
+	// Record is a JSON object, so we write as-is
+	buffer.WriteString(string(marbleAsBytes))
+	buffer.WriteString("}")
+	return nil
+}
+
+// ===== Example: Parameterized range query ================================================
+// queryMarblesByOwnerIndex queries for the marbles of an owner identity using a
+// GetStateByPartialCompositeKey (range query) against the owner~name index. Unlike
+// queryMarblesByOwner, which matches the owner name, it only finds the marbles of that identity.
+// Available on any state database.
+// =========================================================================================
+func (t *SimpleChaincode) queryMarblesByOwnerIndex(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "Org1MSP/bob@org1.example.com"
+	if len(args) < 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	owner := args[0]
+
+	ownedMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey(ownerIndex, []string{owner})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer ownedMarbleResultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for ownedMarbleResultsIterator.HasNext() {
+		responseRange, err := ownedMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the marble name from the owner~name composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = addMarbleToResponse(stub, &buffer, compositeKeyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryMarblesByOwnerIndex queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================================
+// queryMarblesBySizeRange queries for marbles whose size is between a minimum and a maximum,
+// both inclusive, in order of size. Composite keys cannot be passed to GetStateByRange, so
+// the size~name index is read from its start until a larger size is found.
+// Available on any state database.
+// ===========================================================================================
+func (t *SimpleChaincode) queryMarblesBySizeRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0     1
+	// "10", "50"
+	if len(args) < 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	minSize, err := strconv.Atoi(args[0])
+	if err != nil || minSize < 0 {
+		return shim.Error("1st argument must be a non-negative numeric string")
+	}
+	maxSize, err := strconv.Atoi(args[1])
+	if err != nil || maxSize < minSize {
+		return shim.Error("2nd argument must be a numeric string no less than the 1st")
+	}
+
+	sizedMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey(sizeIndex, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer sizedMarbleResultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for sizedMarbleResultsIterator.HasNext() {
+		responseRange, err := sizedMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the size and name from the size~name composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if compositeKeyParts[0] < sizeKey(minSize) {
+			continue
+		}
+		if compositeKeyParts[0] > sizeKey(maxSize) {
+			break
+		}
+		err = addMarbleToResponse(stub, &buffer, compositeKeyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryMarblesBySizeRange queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
+
+type reindexResult struct {
+	Reindexed int    `json:"reindexed"`
+	Bookmark  string `json:"bookmark"` //name of the next marble to reindex, empty once all have been
+}
+
+// ===========================================================================================
+// reindexMarbles saves the owner~name and size~name index entries of up to limit marbles,
+// maxBatchSize by default, in order of name starting from the marble named by bookmark, so that
+// marbles created before the indexes can be found through them. If more marbles remain, the name
+// of the next one is returned as the bookmark to pass to the next call. Deleted marbles are
+// skipped. Admin only.
+// ===========================================================================================
+func (t *SimpleChaincode) reindexMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0     1
+	// "10", "marble5"   - both optional
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 0 to 2")
+	}
+	limit := maxBatchSize
+	if len(args) > 0 && len(args[0]) > 0 {
+		var err error
+		limit, err = strconv.Atoi(args[0])
+		if err != nil || limit <= 0 || limit > maxBatchSize {
+			return shim.Error(fmt.Sprintf("1st argument must be a numeric string between 1 and %d", maxBatchSize))
+		}
+	}
+	bookmark := ""
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+	fmt.Println("- start reindexMarbles ", limit, bookmark)
+
+	admin, err := isAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !admin {
+		return shim.Error("Only an admin may reindex marbles")
+	}
+
+	// Marbles are stored under their names, so a range from the bookmark visits them in order.
+	// Composite keys start with a null character and sort before every marble name.
+	resultsIterator, err := stub.GetStateByRange(bookmark, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	result := &reindexResult{}
+	for resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		marbleJSON := marble{}
+		err = json.Unmarshal(responseRange.Value, &marbleJSON)
+		if err != nil || marbleJSON.ObjectType != "marble" || isArchived(responseRange.Value) {
+			continue
+		}
+		if result.Reindexed == limit {
+			result.Bookmark = responseRange.Key
+			break
+		}
+
+		// index entries hold no value, so saving them again leaves existing ones unchanged
+		err = indexMarble(stub, &marbleJSON)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result.Reindexed++
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end reindexMarbles: " + string(resultAsBytes))
+	return shim.Success(resultAsBytes)
+}
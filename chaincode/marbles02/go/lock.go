@@ -0,0 +1,222 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Locking marbles ====
+// A marble can be locked to freeze it while a dispute is resolved or an operation is pending,
+// e.g. payment for a trade agreed outside the chaincode. The owner, or an admin, locks a marble and
+// names its lock holder, a counterparty or arbiter other than the owner; only the holder or an
+// admin may unlock it, so the owner cannot lift the lock on their own. A locked marble cannot be
+// transferred, traded, updated or deleted. Locks are indexed under lock~holder~name keys so that
+// the marbles locked by a holder can be listed with a range query.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// lockIndex is the composite key under which locks are indexed by holder
+const lockIndex = "lock~holder~name"
+
+type lock struct {
+	Holder   string `json:"holder"`   //identity which may unlock the marble, never the owner
+	LockedAt string `json:"lockedAt"` //RFC 3339
+	Reason   string `json:"reason"`
+}
+
+// ===========================================================================================
+// checkNotLocked returns an error if the marble is locked
+// ===========================================================================================
+func checkNotLocked(marbleJSON *marble) error {
+	if marbleJSON.Lock != nil {
+		return fmt.Errorf("Marble %s is locked by %s: %s", marbleJSON.Name, marbleJSON.Lock.Holder, marbleJSON.Lock.Reason)
+	}
+	return nil
+}
+
+// ===========================================================================
+// lockMarble - freeze a marble until the holder named by the owner unlocks it
+// ===========================================================================
+func (t *SimpleChaincode) lockMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0          1                                   2
+	// "marble1", "Org1MSP/carol@org1.example.com", "disputed"
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[1]) <= 0 {
+		return shim.Error("2nd argument must be a non-empty string")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
+	}
+
+	marbleName := args[0]
+	holder := args[1]
+	reason := args[2]
+	fmt.Println("- start lockMarble ", marbleName, holder, reason)
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToLock := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotArchived(&marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotLocked(&marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// only the owner may lock the marble, and a lock the owner holds would freeze nothing
+	err = checkOwner(stub, &marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if holder == marbleToLock.OwnerID {
+		return shim.Error("The lock holder of marble " + marbleName + " must not be its owner")
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error("Failed to get transaction timestamp: " + err.Error())
+	}
+	marbleToLock.Lock = &lock{holder, now.Format(time.RFC3339), reason}
+
+	marbleJSONasBytes, err := json.Marshal(marbleToLock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putIndexEntry(stub, lockIndex, []string{holder, marbleName})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end lockMarble (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// unlockMarble - release the lock on a marble, by its holder or an admin. The owner may not
+// unlock the marble unless they are an admin.
+// ===========================================================================================
+func (t *SimpleChaincode) unlockMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	fmt.Println("- start unlockMarble ", marbleName)
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToUnlock := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToUnlock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if marbleToUnlock.Lock == nil {
+		return shim.Error("Marble " + marbleName + " is not locked")
+	}
+
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if caller != marbleToUnlock.Lock.Holder {
+		admin, err := isAdmin(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !admin {
+			return shim.Error("Marble " + marbleName + " can only be unlocked by " + marbleToUnlock.Lock.Holder)
+		}
+	}
+
+	err = delIndexEntry(stub, lockIndex, []string{marbleToUnlock.Lock.Holder, marbleName})
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+	marbleToUnlock.Lock = nil
+	marbleJSONasBytes, err := json.Marshal(marbleToUnlock)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end unlockMarble (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// queryLocksByHolder lists the marbles locked by a holder, using a range query against the
+// lock~holder~name index. Available on any state database.
+// ===========================================================================================
+func (t *SimpleChaincode) queryLocksByHolder(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "Org1MSP/bob@org1.example.com"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	holder := args[0]
+
+	lockedMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey(lockIndex, []string{holder})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer lockedMarbleResultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for lockedMarbleResultsIterator.HasNext() {
+		responseRange, err := lockedMarbleResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the marble name from the lock~holder~name composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = addMarbleToResponse(stub, &buffer, compositeKeyParts[1])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	buffer.WriteString("]")
+
+	fmt.Printf("- queryLocksByHolder queryResult:\n%s\n", buffer.String())
+	return shim.Success(buffer.Bytes())
+}
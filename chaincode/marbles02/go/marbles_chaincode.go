@@ -8,21 +8,45 @@
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble1","blue","35","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble2","red","50","tom"]}'
 // peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarble","marble3","blue","70","tom"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry"]}'
-// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["initMarbles","[{\"name\":\"marble4\",\"color\":\"red\",\"size\":20,\"owner\":\"tom\"}]"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarble","marble2","jerry","Org1MSP/User2@org1.example.com"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["updateMarble","marble2","green",""]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColor","blue","jerry","Org1MSP/User2@org1.example.com"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnColorWithPagination","blue","jerry","Org1MSP/User2@org1.example.com","10",""]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["transferMarblesBasedOnOwner","Org1MSP/User1@org1.example.com","jerry","Org1MSP/User2@org1.example.com","10",""]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["delete","marble1","lost"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["restoreMarble","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["purgeMarble","marble1"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["reindexMarbles","100",""]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["lockMarble","marble2","Org1MSP/User2@org1.example.com","disputed"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["unlockMarble","marble2"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["offerMarble","marble3","jerry","Org1MSP/User2@org1.example.com","100","2019-01-01T00:00:00Z"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["acceptOffer","marble3"]}'
+// peer chaincode invoke -C myc1 -n marbles -c '{"Args":["cancelOffer","marble3","Org1MSP/User2@org1.example.com"]}'
+//
+// A marble is owned by the identity which created it, e.g. Org1MSP/User1@org1.example.com, and is
+// transferred to the identity given to transferMarble. Only the owner, or a client whose certificate
+// has the attribute marbles.admin=true, may transfer, update, delete or restore a marble. A deleted
+// marble is archived rather than removed from state; only an admin may purge it. A locked marble
+// cannot be transferred, updated or deleted until its lock holder, a counterparty or arbiter named
+// by the owner, or an admin unlocks it.
 
 // ==== Query marbles ====
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["readMarble","marble1"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getMarblesByRange","marble1","marble3"]}'
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["getHistoryForMarble","marble1","10","2019-01-01T00:00:00Z","diff"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryOffersByOwner","Org1MSP/User1@org1.example.com"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryLocksByHolder","Org1MSP/User1@org1.example.com"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwnerIndex","Org1MSP/User1@org1.example.com"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesBySizeRange","10","50"]}'
 
 // Rich Query (Only supported if CouchDB is used as state database):
 // peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesByOwner","tom"]}'
-// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"}}"]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\"},\"limit\":10}"]}'
 
 // Rich Query with Pagination (Only supported if CouchDB is used as state database):
-// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesWithPagination","{\"selector\":{\"owner\":\"tom\"}}","3",""]}'
+// peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarblesWithPagination","{\"selector\":{\"owner\":\"tom\"},\"limit\":3}",""]}'
 
 // INDEXES TO SUPPORT COUCHDB RICH QUERIES
 //
@@ -33,8 +57,9 @@
 // CouchDB index JSON syntax as documented at:
 // http://docs.couchdb.org/en/2.1.1/api/database/find.html#db-index
 //
-// This marbles02 example chaincode demonstrates a packaged
-// index which you can find in META-INF/statedb/couchdb/indexes/indexOwner.json.
+// This marbles02 example chaincode demonstrates packaged indexes which you can find in
+// META-INF/statedb/couchdb/indexes/indexOwner.json and indexSize.json. queryMarbles and
+// queryMarblesWithPagination only run queries covered by these indexes, see query.go.
 // For deployment of chaincode to production environments, it is recommended
 // to define any indexes alongside chaincode so that the chaincode and supporting indexes
 // are deployed automatically as a unit, once the chaincode has been installed on a peer and
@@ -66,16 +91,16 @@
 // curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"docType\",\"owner\"]},\"name\":\"indexOwner\",\"ddoc\":\"indexOwnerDoc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
 //
 
-// Index for docType, owner, size (descending order).
+// Index for docType, size.
 //
 // Example curl command line to define index in the CouchDB channel_chaincode database
-// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[{\"size\":\"desc\"},{\"docType\":\"desc\"},{\"owner\":\"desc\"}]},\"ddoc\":\"indexSizeSortDoc\", \"name\":\"indexSizeSortDesc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
+// curl -i -X POST -H "Content-Type: application/json" -d "{\"index\":{\"fields\":[\"docType\",\"size\"]},\"name\":\"indexSize\",\"ddoc\":\"indexSizeDoc\",\"type\":\"json\"}" http://hostname:port/myc1_marbles/_index
 
-// Rich Query with index design doc and index name specified (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":\"marble\",\"owner\":\"tom\"}, \"use_index\":[\"_design/indexOwnerDoc\", \"indexOwner\"]}"]}'
+// Rich Query covered by the owner index (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"owner\":\"tom\",\"color\":{\"$in\":[\"blue\",\"red\"]}},\"limit\":10}"]}'
 
-// Rich Query with index design doc specified only (Only supported if CouchDB is used as state database):
-//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"docType\":{\"$eq\":\"marble\"},\"owner\":{\"$eq\":\"tom\"},\"size\":{\"$gt\":0}},\"fields\":[\"docType\",\"owner\",\"size\"],\"sort\":[{\"size\":\"desc\"}],\"use_index\":\"_design/indexSizeSortDoc\"}"]}'
+// Rich Query covered by the size index, sorted by size (Only supported if CouchDB is used as state database):
+//   peer chaincode query -C myc1 -n marbles -c '{"Args":["queryMarbles","{\"selector\":{\"size\":{\"$gt\":0}},\"sort\":[{\"size\":\"desc\"}],\"limit\":10}"]}'
 
 package main
 
@@ -83,9 +108,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -96,11 +121,14 @@ type SimpleChaincode struct {
 }
 
 type marble struct {
-	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
-	Name       string `json:"name"`    //the fieldtags are needed to keep case from bouncing around
-	Color      string `json:"color"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
+	ObjectType string   `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Name       string   `json:"name"`    //the fieldtags are needed to keep case from bouncing around
+	Color      string   `json:"color"`
+	Size       int      `json:"size"`
+	Owner      string   `json:"owner"`
+	OwnerID    string   `json:"ownerId"`            //MSP-qualified identity of the owner, see callerIdentity
+	Archived   *archive `json:"archived,omitempty"` //set once the marble has been deleted, see archive.go
+	Lock       *lock    `json:"lock,omitempty"`     //set while the marble is locked, see lock.go
 }
 
 // ===================================================================================
@@ -130,14 +158,46 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.initMarble(stub, args)
 	} else if function == "transferMarble" { //change owner of a specific marble
 		return t.transferMarble(stub, args)
+	} else if function == "updateMarble" { //change the color and/or size of a specific marble
+		return t.updateMarble(stub, args)
+	} else if function == "initMarbles" { //create several marbles at once
+		return t.initMarbles(stub, args)
+	} else if function == "transferMarblesBasedOnOwner" { //transfer all marbles of a certain owner
+		return t.transferMarblesBasedOnOwner(stub, args)
 	} else if function == "transferMarblesBasedOnColor" { //transfer all marbles of a certain color
 		return t.transferMarblesBasedOnColor(stub, args)
+	} else if function == "transferMarblesBasedOnColorWithPagination" { //transfer marbles of a certain color, a page at a time
+		return t.transferMarblesBasedOnColorWithPagination(stub, args)
 	} else if function == "delete" { //delete a marble
 		return t.delete(stub, args)
+	} else if function == "restoreMarble" { //restore a deleted marble
+		return t.restoreMarble(stub, args)
+	} else if function == "purgeMarble" { //remove a marble from state for good
+		return t.purgeMarble(stub, args)
+	} else if function == "reindexMarbles" { //rebuild the owner and size indexes
+		return t.reindexMarbles(stub, args)
+	} else if function == "lockMarble" { //freeze a marble
+		return t.lockMarble(stub, args)
+	} else if function == "unlockMarble" { //release the lock on a marble
+		return t.unlockMarble(stub, args)
+	} else if function == "queryLocksByHolder" { //find the marbles locked by a holder
+		return t.queryLocksByHolder(stub, args)
+	} else if function == "offerMarble" { //offer a marble to a buyer
+		return t.offerMarble(stub, args)
+	} else if function == "acceptOffer" { //buy a marble offered to the caller
+		return t.acceptOffer(stub, args)
+	} else if function == "cancelOffer" { //withdraw or decline an offer
+		return t.cancelOffer(stub, args)
+	} else if function == "queryOffersByOwner" { //find the open offers made by an owner
+		return t.queryOffersByOwner(stub, args)
 	} else if function == "readMarble" { //read a marble
 		return t.readMarble(stub, args)
 	} else if function == "queryMarblesByOwner" { //find marbles for owner X using rich query
 		return t.queryMarblesByOwner(stub, args)
+	} else if function == "queryMarblesByOwnerIndex" { //find marbles for owner X using the owner~name index
+		return t.queryMarblesByOwnerIndex(stub, args)
+	} else if function == "queryMarblesBySizeRange" { //find marbles with a size between X and Y using the size~name index
+		return t.queryMarblesBySizeRange(stub, args)
 	} else if function == "queryMarbles" { //find marbles based on an ad hoc rich query
 		return t.queryMarbles(stub, args)
 	} else if function == "getHistoryForMarble" { //get history of values for a marble
@@ -184,8 +244,8 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	color := strings.ToLower(args[1])
 	owner := strings.ToLower(args[3])
 	size, err := strconv.Atoi(args[2])
-	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+	if err != nil || size < 0 {
+		return shim.Error("3rd argument must be a non-negative numeric string")
 	}
 
 	// ==== Check if marble already exists ====
@@ -197,9 +257,15 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 		return shim.Error("This marble already exists: " + marbleName)
 	}
 
+	// ==== The caller becomes the owner of the marble ====
+	ownerID, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ==== Create marble object and marshal to JSON ====
 	objectType := "marble"
-	marble := &marble{objectType, marbleName, color, size, owner}
+	marble := &marble{objectType, marbleName, color, size, owner, ownerID, nil, nil}
 	marbleJSONasBytes, err := json.Marshal(marble)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -229,6 +295,12 @@ func (t *SimpleChaincode) initMarble(stub shim.ChaincodeStubInterface, args []st
 	value := []byte{0x00}
 	stub.PutState(colorNameIndexKey, value)
 
+	//  ==== Index the marble by owner and size as well, see indexes.go ====
+	err = indexMarble(stub, marble)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// ==== Marble saved and indexed. Return success ====
 	fmt.Println("- end init marble")
 	return shim.Success(nil)
@@ -258,16 +330,24 @@ func (t *SimpleChaincode) readMarble(stub shim.ChaincodeStubInterface, args []st
 	return shim.Success(valAsbytes)
 }
 
-// ==================================================
-// delete - remove a marble key/value pair from state
-// ==================================================
+// ==================================================================================
+// delete - archive a marble, removing it from the indexes and queries but keeping it
+// in state so that it can be restored. See purgeMarble to remove it from state.
+// ==================================================================================
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var jsonResp string
 	var marbleJSON marble
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+
+	//   0          1
+	// "marble1", "lost"   - the reason is optional
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 1 or 2")
 	}
 	marbleName := args[0]
+	reason := ""
+	if len(args) > 1 {
+		reason = args[1]
+	}
 
 	// to maintain the color~name index, we need to read the marble first and get its color
 	valAsbytes, err := stub.GetState(marbleName) //get the marble from chaincode state
@@ -284,25 +364,69 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + marbleName + "\"}"
 		return shim.Error(jsonResp)
 	}
+	err = checkNotArchived(&marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotLocked(&marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	err = stub.DelState(marbleName) //remove the marble from chaincode state
+	// only the owner may delete the marble
+	err = checkOwner(stub, &marbleJSON)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return shim.Error(err.Error())
+	}
+
+	// mark the marble as archived by the caller
+	marbleJSON.Archived, err = newArchive(stub, reason)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	marbleJSONasBytes, err := json.Marshal(marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// maintain the indexes
+	err = removeFromIndexes(stub, &marbleJSON)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
+	return shim.Success(nil)
+}
 
-	// maintain the index
+// ===========================================================================================
+// removeFromIndexes deletes the index entries of a marble and withdraws any offers made on it
+// ===========================================================================================
+func removeFromIndexes(stub shim.ChaincodeStubInterface, marbleJSON *marble) error {
 	indexName := "color~name"
 	colorNameIndexKey, err := stub.CreateCompositeKey(indexName, []string{marbleJSON.Color, marbleJSON.Name})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	//  Delete index entry to state.
 	err = stub.DelState(colorNameIndexKey)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return fmt.Errorf("Failed to delete state:%s", err.Error())
 	}
-	return shim.Success(nil)
+	err = unindexMarble(stub, marbleJSON)
+	if err != nil {
+		return fmt.Errorf("Failed to delete state:%s", err.Error())
+	}
+
+	// withdraw any offers made on the marble
+	err = deleteOffers(stub, marbleJSON.Name, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to delete offers:%s", err.Error())
+	}
+	return nil
 }
 
 // ===========================================================
@@ -310,15 +434,19 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 // ===========================================================
 func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "name", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1      2
+	// "name", "bob", "Org1MSP/bob@org1.example.com"
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[2]) <= 0 {
+		return shim.Error("3rd argument must be a non-empty string")
 	}
 
 	marbleName := args[0]
 	newOwner := strings.ToLower(args[1])
-	fmt.Println("- start transferMarble ", marbleName, newOwner)
+	newOwnerID := args[2]
+	fmt.Println("- start transferMarble ", marbleName, newOwner, newOwnerID)
 
 	marbleAsBytes, err := stub.GetState(marbleName)
 	if err != nil {
@@ -332,10 +460,11 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	marbleToTransfer.Owner = newOwner //change the owner
-
-	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
-	err = stub.PutState(marbleName, marbleJSONasBytes) //rewrite the marble
+	err = checkTransferable(stub, &marbleToTransfer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = changeOwner(stub, &marbleToTransfer, newOwner, newOwnerID)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -344,9 +473,135 @@ func (t *SimpleChaincode) transferMarble(stub shim.ChaincodeStubInterface, args
 	return shim.Success(nil)
 }
 
+// ==============================================================================
+// updateMarble - repaint and/or resize a marble, moving its index entries along
+// ==============================================================================
+func (t *SimpleChaincode) updateMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0       1       2
+	// "name", "red",  "50"     - an empty color or size is left unchanged
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return shim.Error("1st argument must be a non-empty string")
+	}
+	if len(args[1]) <= 0 && len(args[2]) <= 0 {
+		return shim.Error("Either the 2nd or the 3rd argument must be a non-empty string")
+	}
+
+	marbleName := args[0]
+	fmt.Println("- start updateMarble ", marbleName, args[1], args[2])
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+
+	marbleToUpdate := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotArchived(&marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotLocked(&marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkOwner(stub, &marbleToUpdate) //only the owner may update the marble
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// ==== Validate the new attributes ====
+	color := marbleToUpdate.Color
+	if len(args[1]) > 0 {
+		color = strings.ToLower(args[1])
+	}
+	size := marbleToUpdate.Size
+	if len(args[2]) > 0 {
+		size, err = strconv.Atoi(args[2])
+		if err != nil || size < 0 {
+			return shim.Error("3rd argument must be a non-negative numeric string")
+		}
+	}
+	if color == marbleToUpdate.Color && size == marbleToUpdate.Size {
+		return shim.Error("Marble " + marbleName + " is already " + color + " and of size " + strconv.Itoa(size))
+	}
+
+	// ==== Remove the index entries of the old attributes ====
+	err = delIndexEntry(stub, "color~name", []string{marbleToUpdate.Color, marbleToUpdate.Name})
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+	err = unindexMarble(stub, &marbleToUpdate)
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+
+	// ==== Rewrite the marble, which adds the change to its history, and index it again ====
+	marbleToUpdate.Color = color
+	marbleToUpdate.Size = size
+	marbleJSONasBytes, err := json.Marshal(marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(marbleName, marbleJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putIndexEntry(stub, "color~name", []string{marbleToUpdate.Color, marbleToUpdate.Name})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = indexMarble(stub, &marbleToUpdate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// offers were made on the marble as it was, so withdraw them
+	err = deleteOffers(stub, marbleName, nil)
+	if err != nil {
+		return shim.Error("Failed to delete offers:" + err.Error())
+	}
+
+	fmt.Println("- end updateMarble (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// changeOwner sets a new owner on a marble, rewrites it and moves its owner~name index entry.
+// Offers made on the marble by the previous owner are withdrawn.
+// ===========================================================================================
+func changeOwner(stub shim.ChaincodeStubInterface, marbleToTransfer *marble, newOwner string, newOwnerID string) error {
+	err := unindexMarble(stub, marbleToTransfer)
+	if err != nil {
+		return err
+	}
+	marbleToTransfer.Owner = newOwner //change the owner
+	marbleToTransfer.OwnerID = newOwnerID
+
+	marbleJSONasBytes, _ := json.Marshal(marbleToTransfer)
+	err = stub.PutState(marbleToTransfer.Name, marbleJSONasBytes) //rewrite the marble
+	if err != nil {
+		return err
+	}
+	err = indexMarble(stub, marbleToTransfer)
+	if err != nil {
+		return err
+	}
+
+	return deleteOffers(stub, marbleToTransfer.Name, nil)
+}
+
 // ===========================================================================================
 // constructQueryResponseFromIterator constructs a JSON array containing query results from
-// a given result iterator
+// a given result iterator, leaving out deleted marbles
 // ===========================================================================================
 func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorInterface) (*bytes.Buffer, error) {
 	// buffer is a JSON array containing QueryResults
@@ -359,6 +614,10 @@ func constructQueryResponseFromIterator(resultsIterator shim.StateQueryIteratorI
 		if err != nil {
 			return nil, err
 		}
+		// Deleted marbles are kept in state but hidden from queries
+		if isArchived(queryResponse.Value) {
+			continue
+		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -440,55 +699,36 @@ func (t *SimpleChaincode) getMarblesByRange(stub shim.ChaincodeStubInterface, ar
 // between endorsement time and commit time. The transaction is invalidated by the
 // committing peers if the result set has changed between endorsement time and commit time.
 // Therefore, range queries are a safe option for performing update transactions based on query results.
+// Every marble of the color is handled in one transaction, marbles the caller may not transfer are
+// skipped and listed in the response, see transferMarblesFromIndex.
 // ===========================================================================================
 func (t *SimpleChaincode) transferMarblesBasedOnColor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0       1
-	// "color", "bob"
-	if len(args) < 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	//   0       1      2
+	// "color", "bob", "Org1MSP/bob@org1.example.com"
+	if len(args) < 3 {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
 	}
 
 	color := args[0]
 	newOwner := strings.ToLower(args[1])
-	fmt.Println("- start transferMarblesBasedOnColor ", color, newOwner)
+	newOwnerID := args[2]
+	fmt.Println("- start transferMarblesBasedOnColor ", color, newOwner, newOwnerID)
 
-	// Query the color~name index by color
-	// This will execute a key range query on all keys starting with 'color'
-	coloredMarbleResultsIterator, err := stub.GetStateByPartialCompositeKey("color~name", []string{color})
+	// Query the color~name index by color, without a limit
+	result, err := t.transferMarblesFromIndex(stub, "color~name", color, newOwner, newOwnerID, math.MaxInt32, "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer coloredMarbleResultsIterator.Close()
 
-	// Iterate through result set and for each marble found, transfer to newOwner
-	var i int
-	for i = 0; coloredMarbleResultsIterator.HasNext(); i++ {
-		// Note that we don't get the value (2nd return variable), we'll just get the marble name from the composite key
-		responseRange, err := coloredMarbleResultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// get the color and name from color~name composite key
-		objectType, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		returnedColor := compositeKeyParts[0]
-		returnedMarbleName := compositeKeyParts[1]
-		fmt.Printf("- found a marble from index:%s color:%s name:%s\n", objectType, returnedColor, returnedMarbleName)
-
-		// Now call the transfer function for the found marble.
-		// Re-use the same function that is used to transfer individual marbles
-		response := t.transferMarble(stub, []string{returnedMarbleName, newOwner})
-		// if the transfer failed break out of loop and return error
-		if response.Status != shim.OK {
-			return shim.Error("Transfer failed: " + response.Message)
+	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", result.Transferred, color, newOwner)
+	if len(result.Skipped) > 0 {
+		skipped := make([]string, len(result.Skipped))
+		for i, s := range result.Skipped {
+			skipped[i] = s.Name + " (" + s.Reason + ")"
 		}
+		responsePayload += ", skipped " + strings.Join(skipped, ", ")
 	}
-
-	responsePayload := fmt.Sprintf("Transferred %d %s marbles to %s", i, color, newOwner)
 	fmt.Println("- end transferMarblesBasedOnColor: " + responsePayload)
 	return shim.Success([]byte(responsePayload))
 }
@@ -522,7 +762,7 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 
 	owner := strings.ToLower(args[0])
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\"}}", owner)
+	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"marble\",\"owner\":\"%s\",\"archived\":{\"$exists\":false}}}", owner)
 
 	queryResults, err := getQueryResultForQueryString(stub, queryString)
 	if err != nil {
@@ -532,8 +772,9 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 }
 
 // ===== Example: Ad hoc rich query ========================================================
-// queryMarbles uses a query string to perform a query for marbles.
-// Query string matching state database syntax is passed in and executed as is.
+// queryMarbles uses a structured query to perform a query for marbles.
+// The CouchDB query string is built from it by buildQueryString, which only accepts
+// queries on marbles that are covered by a shipped index, see query.go.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
 // Only available on state databases that support rich query (e.g. CouchDB)
@@ -541,18 +782,33 @@ func (t *SimpleChaincode) queryMarblesByOwner(stub shim.ChaincodeStubInterface,
 func (t *SimpleChaincode) queryMarbles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	//   0
-	// "queryString"
+	// "query"
 	if len(args) < 1 {
 		return shim.Error("Incorrect number of arguments. Expecting 1")
 	}
 
-	queryString := args[0]
+	queryString, limit, err := buildQueryString(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	fmt.Printf("- queryMarbles queryString:\n%s\n", queryString)
+
+	// the limit is enforced as the page size of the first page
+	resultsIterator, _, err := stub.GetQueryResultWithPagination(queryString, limit, "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	return shim.Success(queryResults)
+	defer resultsIterator.Close()
+
+	buffer, err := constructQueryResponseFromIterator(resultsIterator)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- queryMarbles queryResult:\n%s\n", buffer.String())
+
+	return shim.Success(buffer.Bytes())
 }
 
 // =========================================================================================
@@ -632,8 +888,8 @@ func (t *SimpleChaincode) getMarblesByRangeWithPagination(stub shim.ChaincodeStu
 }
 
 // ===== Example: Pagination with Ad hoc Rich Query ========================================================
-// queryMarblesWithPagination uses a query string, page size and a bookmark to perform a query
-// for marbles. Query string matching state database syntax is passed in and executed as is.
+// queryMarblesWithPagination uses a structured query and a bookmark to perform a query
+// for marbles. The query is built as for queryMarbles and its limit is the page size.
 // The number of fetched records would be equal to or lesser than the specified page size.
 // Supports ad hoc queries that can be defined at runtime by the client.
 // If this is not desired, follow the queryMarblesForOwner example for parameterized queries.
@@ -642,21 +898,19 @@ func (t *SimpleChaincode) getMarblesByRangeWithPagination(stub shim.ChaincodeStu
 // =========================================================================================
 func (t *SimpleChaincode) queryMarblesWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//   0
-	// "queryString"
-	if len(args) < 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+	//   0        1
+	// "query", "bookmark"
+	if len(args) < 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
 	}
 
-	queryString := args[0]
-	//return type of ParseInt is int64
-	pageSize, err := strconv.ParseInt(args[1], 10, 32)
+	queryString, pageSize, err := buildQueryString(args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	bookmark := args[2]
+	bookmark := args[1]
 
-	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, int32(pageSize), bookmark)
+	queryResults, err := getQueryResultForQueryStringWithPagination(stub, queryString, pageSize, bookmark)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -688,68 +942,3 @@ func getQueryResultForQueryStringWithPagination(stub shim.ChaincodeStubInterface
 
 	return buffer.Bytes(), nil
 }
-
-func (t *SimpleChaincode) getHistoryForMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-
-	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
-	marbleName := args[0]
-
-	fmt.Printf("- start getHistoryForMarble: %s\n", marbleName)
-
-	resultsIterator, err := stub.GetHistoryForKey(marbleName)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing historic values for the marble
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
-		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON marble)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
-		}
-
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
-
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
-	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- getHistoryForMarble returning:\n%s\n", buffer.String())
-
-	return shim.Success(buffer.Bytes())
-}
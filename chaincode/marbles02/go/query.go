@@ -0,0 +1,255 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Structured rich queries ====
+// queryMarbles and queryMarblesWithPagination do not pass a client's CouchDB query through as is,
+// since it could scan the whole state database or read documents other than marbles. They take a
+// structured query instead, from which the CouchDB query is built here:
+//
+//   {"selector":{"owner":"tom","size":{"$gt":10}},"sort":[{"size":"desc"}],"limit":10}
+//
+// The selector may only constrain the fields in queryFields, each with the operators in
+// queryOperators or with a plain value for $eq, and is always restricted to docType marble and to
+// marbles which have not been deleted. The limit is mandatory and at most maxQueryLimit. The query
+// must be covered by one of the indexes shipped in META-INF/statedb/couchdb/indexes, listed in
+// shippedIndexes: every field of the index must be constrained by the selector, and the query may
+// only be sorted on fields of the index. The index is named in use_index so that CouchDB does not
+// fall back to a full scan.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxQueryLimit is the largest number of marbles a single structured query may return
+const maxQueryLimit = 100
+
+// queryFields are the marble fields a query may constrain, with the JSON type of their values
+var queryFields = map[string]string{
+	"name":    "string",
+	"color":   "string",
+	"size":    "number",
+	"owner":   "string",
+	"ownerId": "string",
+}
+
+// queryOperators are the CouchDB operators a query may use
+var queryOperators = map[string]bool{
+	"$eq":  true,
+	"$gt":  true,
+	"$gte": true,
+	"$lt":  true,
+	"$lte": true,
+	"$in":  true,
+}
+
+// couchIndex is an index shipped with the chaincode. Every index starts with docType, which is
+// not listed in Fields.
+type couchIndex struct {
+	DesignDoc string
+	Name      string
+	Fields    []string
+}
+
+// shippedIndexes must match the index definitions in META-INF/statedb/couchdb/indexes
+var shippedIndexes = []couchIndex{
+	{"indexOwnerDoc", "indexOwner", []string{"owner"}},
+	{"indexSizeDoc", "indexSize", []string{"size"}},
+}
+
+// marbleQuery is the structured query accepted from clients
+type marbleQuery struct {
+	Selector map[string]json.RawMessage `json:"selector"`
+	Sort     []map[string]string        `json:"sort"`
+	Limit    int32                      `json:"limit"`
+}
+
+// couchQuery is the CouchDB query built from a marbleQuery
+type couchQuery struct {
+	Selector map[string]interface{} `json:"selector"`
+	Sort     []map[string]string    `json:"sort,omitempty"`
+	UseIndex []string               `json:"use_index"`
+}
+
+// ===========================================================================================
+// checkQueryValue checks that a value compared with a field has the field's type. String values
+// are lowercased where the field is stored lowercased.
+// ===========================================================================================
+func checkQueryValue(field string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if queryFields[field] != "string" {
+			return nil, fmt.Errorf("Field %s must be compared with a %s", field, queryFields[field])
+		}
+		if field == "color" || field == "owner" {
+			return strings.ToLower(v), nil
+		}
+		return v, nil
+	case float64:
+		if queryFields[field] != "number" {
+			return nil, fmt.Errorf("Field %s must be compared with a %s", field, queryFields[field])
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("Field %s must be compared with a %s", field, queryFields[field])
+}
+
+// ===========================================================================================
+// buildCondition builds the CouchDB condition on a field from the selector of a structured query
+// ===========================================================================================
+func buildCondition(field string, raw json.RawMessage) (map[string]interface{}, error) {
+	var condition interface{}
+	err := json.Unmarshal(raw, &condition)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the condition on %s: %s", field, err.Error())
+	}
+
+	operators, ok := condition.(map[string]interface{})
+	if !ok {
+		// a plain value is shorthand for $eq
+		operators = map[string]interface{}{"$eq": condition}
+	}
+	if len(operators) == 0 {
+		return nil, fmt.Errorf("The condition on %s is empty", field)
+	}
+
+	built := map[string]interface{}{}
+	for operator, value := range operators {
+		if !queryOperators[operator] {
+			return nil, fmt.Errorf("Operator %s is not supported", operator)
+		}
+
+		if operator != "$in" {
+			built[operator], err = checkQueryValue(field, value)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok || len(values) == 0 || len(values) > maxQueryLimit {
+			return nil, fmt.Errorf("Operator $in on %s must be given between 1 and %d values", field, maxQueryLimit)
+		}
+		for i := range values {
+			values[i], err = checkQueryValue(field, values[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		built[operator] = values
+	}
+	return built, nil
+}
+
+// ===========================================================================================
+// buildQueryString validates a structured query and builds the CouchDB query string from it.
+// The limit of the query is returned as the page size to run it with.
+// ===========================================================================================
+func buildQueryString(query string) (string, int32, error) {
+	parsed := marbleQuery{}
+	decoder := json.NewDecoder(strings.NewReader(query))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&parsed)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to decode query: %s", err.Error())
+	}
+	if parsed.Limit <= 0 || parsed.Limit > maxQueryLimit {
+		return "", 0, fmt.Errorf("The query must have a limit between 1 and %d", maxQueryLimit)
+	}
+
+	// ==== Build the selector, pinned to marbles which have not been deleted ====
+	built := couchQuery{Selector: map[string]interface{}{"docType": "marble", "archived": map[string]bool{"$exists": false}}}
+	for field, raw := range parsed.Selector {
+		if _, ok := queryFields[field]; !ok {
+			return "", 0, fmt.Errorf("Field %s cannot be queried", field)
+		}
+		built.Selector[field], err = buildCondition(field, raw)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+
+	// ==== Check the sort, which must be in a single direction ====
+	direction := ""
+	for _, sortField := range parsed.Sort {
+		if len(sortField) != 1 {
+			return "", 0, fmt.Errorf("Each sort entry must name a single field")
+		}
+		for field, fieldDirection := range sortField {
+			if fieldDirection != "asc" && fieldDirection != "desc" {
+				return "", 0, fmt.Errorf("Sort direction of %s must be asc or desc", field)
+			}
+			if direction != "" && fieldDirection != direction {
+				return "", 0, fmt.Errorf("All sort fields must be sorted in the same direction")
+			}
+			direction = fieldDirection
+		}
+	}
+
+	// ==== Find a shipped index covering the query ====
+	var index *couchIndex
+	for i := range shippedIndexes {
+		if indexCovers(&shippedIndexes[i], built.Selector, parsed.Sort) {
+			index = &shippedIndexes[i]
+			break
+		}
+	}
+	if index == nil {
+		return "", 0, fmt.Errorf("The query is not covered by an index, it must constrain %s and only be sorted on the constrained field", indexFieldsDescription())
+	}
+	built.UseIndex = []string{"_design/" + index.DesignDoc, index.Name}
+	if len(parsed.Sort) > 0 {
+		// sort on the index fields in order, starting with docType
+		built.Sort = append([]map[string]string{{"docType": direction}}, parsed.Sort...)
+	}
+
+	queryString, err := json.Marshal(built)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(queryString), parsed.Limit, nil
+}
+
+// ===========================================================================================
+// indexCovers reports whether the selector constrains every field of an index and the query is
+// only sorted on fields of the index
+// ===========================================================================================
+func indexCovers(index *couchIndex, selector map[string]interface{}, sort []map[string]string) bool {
+	for _, field := range index.Fields {
+		if _, ok := selector[field]; !ok {
+			return false
+		}
+	}
+	for _, sortField := range sort {
+		for field := range sortField {
+			if !contains(index.Fields, field) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// contains reports whether a field is one of fields
+func contains(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFieldsDescription describes the fields of the shipped indexes for error messages
+func indexFieldsDescription() string {
+	descriptions := []string{}
+	for _, index := range shippedIndexes {
+		descriptions = append(descriptions, strings.Join(index.Fields, " and "))
+	}
+	return strings.Join(descriptions, " or ")
+}
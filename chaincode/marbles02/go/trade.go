@@ -0,0 +1,435 @@
+/*
+ SPDX-License-Identifier: Apache-2.0
+*/
+
+// ==== Trading marbles ====
+// A trade takes two transactions. The owner offers a marble to a buyer at a price until an expiry
+// time, and the buyer accepts the offer, which transfers the marble to them in the same transaction.
+// Until then either of them may cancel the offer. Offers are stored under offer~marble~buyer keys,
+// so a marble may be offered to several buyers at once; once it changes owner or is deleted all of
+// its offers are withdrawn. Each offer is also indexed under an offerSeller~seller~marble~buyer key
+// so that the offers of a seller can be listed without reading every offer.
+//
+// Offers expire against the transaction timestamp, which is chosen by the submitting client and is
+// not checked by the peers beyond being recorded in the transaction. A buyer can therefore accept
+// an expired offer by submitting a timestamp before its expiry; an expiry only binds buyers whose
+// clients set their timestamps honestly. Sellers who need a hard cutoff should cancel the offer.
+// Expired offers are left in state until they are touched: a new offer on the marble removes
+// them, and anyone may cancel one.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// offerIndex is the composite key under which offers are stored
+const offerIndex = "offer~marble~buyer"
+
+// offerSellerIndex is the composite key under which offers are indexed by seller
+const offerSellerIndex = "offerSeller~seller~marble~buyer"
+
+type offer struct {
+	ObjectType string `json:"docType"` //docType is used to distinguish the various types of objects in state database
+	Marble     string `json:"marble"`
+	Seller     string `json:"seller"` //identity of the owner who made the offer
+	Buyer      string `json:"buyer"`  //owner name the buyer will hold the marble under
+	BuyerID    string `json:"buyerId"`
+	Price      int    `json:"price"`
+	Expiry     string `json:"expiry"` //RFC 3339
+}
+
+// ===========================================================================================
+// txTime returns the timestamp of the transaction, which offers expire against
+// ===========================================================================================
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
+
+// ===========================================================================================
+// getOffer reads an offer from state, returning a nil offer if there is none
+// ===========================================================================================
+func getOffer(stub shim.ChaincodeStubInterface, marbleName string, buyerID string) (string, *offer, error) {
+	offerKey, err := stub.CreateCompositeKey(offerIndex, []string{marbleName, buyerID})
+	if err != nil {
+		return "", nil, err
+	}
+
+	offerAsBytes, err := stub.GetState(offerKey)
+	if err != nil {
+		return "", nil, err
+	} else if offerAsBytes == nil {
+		return offerKey, nil, nil
+	}
+
+	offerJSON := &offer{}
+	err = json.Unmarshal(offerAsBytes, offerJSON)
+	if err != nil {
+		return "", nil, err
+	}
+	return offerKey, offerJSON, nil
+}
+
+// ===========================================================================================
+// putOffer saves an offer along with its offerSeller~seller~marble~buyer index entry
+// ===========================================================================================
+func putOffer(stub shim.ChaincodeStubInterface, offerKey string, offerJSON *offer) error {
+	offerJSONasBytes, err := json.Marshal(offerJSON)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(offerKey, offerJSONasBytes)
+	if err != nil {
+		return err
+	}
+	// only the key is needed for the index entry, so the value is a null character
+	sellerKey, err := stub.CreateCompositeKey(offerSellerIndex, []string{offerJSON.Seller, offerJSON.Marble, offerJSON.BuyerID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(sellerKey, []byte{0x00})
+}
+
+// ===========================================================================================
+// delOffer deletes an offer along with its offerSeller~seller~marble~buyer index entry
+// ===========================================================================================
+func delOffer(stub shim.ChaincodeStubInterface, offerKey string, offerJSON *offer) error {
+	err := stub.DelState(offerKey)
+	if err != nil {
+		return err
+	}
+	sellerKey, err := stub.CreateCompositeKey(offerSellerIndex, []string{offerJSON.Seller, offerJSON.Marble, offerJSON.BuyerID})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(sellerKey)
+}
+
+// ===========================================================================================
+// offerExpired reports whether an offer has expired at a time
+// ===========================================================================================
+func offerExpired(offerJSON *offer, now time.Time) (bool, error) {
+	expiry, err := time.Parse(time.RFC3339, offerJSON.Expiry)
+	if err != nil {
+		return false, err
+	}
+	return !expiry.After(now), nil
+}
+
+// ===========================================================================================
+// deleteOffers withdraws the offers made on a marble, every offer if expiredAt is nil and
+// otherwise only those which have expired by then
+// ===========================================================================================
+func deleteOffers(stub shim.ChaincodeStubInterface, marbleName string, expiredAt *time.Time) error {
+	offerResultsIterator, err := stub.GetStateByPartialCompositeKey(offerIndex, []string{marbleName})
+	if err != nil {
+		return err
+	}
+	defer offerResultsIterator.Close()
+
+	for offerResultsIterator.HasNext() {
+		responseRange, err := offerResultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		offerJSON := &offer{}
+		err = json.Unmarshal(responseRange.Value, offerJSON)
+		if err != nil {
+			return err
+		}
+		if expiredAt != nil {
+			expired, err := offerExpired(offerJSON, *expiredAt)
+			if err != nil {
+				return err
+			}
+			if !expired {
+				continue
+			}
+		}
+		err = delOffer(stub, responseRange.Key, offerJSON)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================================
+// offerMarble - the owner offers a marble to a buyer at a price until an expiry time
+// ===========================================================================================
+func (t *SimpleChaincode) offerMarble(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1       2                              3      4
+	// "marble1", "bob", "Org1MSP/bob@org1.example.com", "100", "2019-01-01T00:00:00Z"
+	if len(args) != 5 {
+		return shim.Error("Incorrect number of arguments. Expecting 5")
+	}
+	for i, arg := range args {
+		if len(arg) <= 0 {
+			return shim.Error(fmt.Sprintf("Argument %d must be a non-empty string", i+1))
+		}
+	}
+
+	marbleName := args[0]
+	buyer := strings.ToLower(args[1])
+	buyerID := args[2]
+	price, err := strconv.Atoi(args[3])
+	if err != nil || price < 0 {
+		return shim.Error("4th argument must be a non-negative numeric string")
+	}
+	expiry, err := time.Parse(time.RFC3339, args[4])
+	if err != nil {
+		return shim.Error("5th argument must be an RFC 3339 time")
+	}
+	fmt.Println("- start offerMarble ", marbleName, buyerID, price, args[4])
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error("Failed to get transaction timestamp: " + err.Error())
+	}
+	if !expiry.After(now) {
+		return shim.Error("The offer has already expired")
+	}
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToOffer := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToOffer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = checkNotArchived(&marbleToOffer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkNotLocked(&marbleToOffer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// only the owner may offer the marble
+	err = checkOwner(stub, &marbleToOffer)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if buyerID == marbleToOffer.OwnerID {
+		return shim.Error("The buyer already owns marble " + marbleName)
+	}
+
+	// clear out the marble's expired offers while it is being offered again
+	err = deleteOffers(stub, marbleName, &now)
+	if err != nil {
+		return shim.Error("Failed to delete expired offers:" + err.Error())
+	}
+
+	offerKey, _, err := getOffer(stub, marbleName, buyerID)
+	if err != nil {
+		return shim.Error("Failed to get offer:" + err.Error())
+	}
+	err = putOffer(stub, offerKey, &offer{"offer", marbleName, marbleToOffer.OwnerID, buyer, buyerID, price, expiry.Format(time.RFC3339)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Println("- end offerMarble (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// acceptOffer - the buyer accepts an offer made to them, taking ownership of the marble
+// ===========================================================================================
+func (t *SimpleChaincode) acceptOffer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "marble1"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	marbleName := args[0]
+	buyerID, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fmt.Println("- start acceptOffer ", marbleName, buyerID)
+
+	_, offerJSON, err := getOffer(stub, marbleName, buyerID)
+	if err != nil {
+		return shim.Error("Failed to get offer:" + err.Error())
+	} else if offerJSON == nil {
+		return shim.Error("No offer of marble " + marbleName + " has been made to " + buyerID)
+	}
+
+	// the timestamp is the buyer's client's own, see the note on expiry at the top of this file
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error("Failed to get transaction timestamp: " + err.Error())
+	}
+	expired, err := offerExpired(offerJSON, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if expired {
+		return shim.Error("The offer expired at " + offerJSON.Expiry)
+	}
+
+	marbleAsBytes, err := stub.GetState(marbleName)
+	if err != nil {
+		return shim.Error("Failed to get marble:" + err.Error())
+	} else if marbleAsBytes == nil {
+		return shim.Error("Marble does not exist")
+	}
+	marbleToBuy := marble{}
+	err = json.Unmarshal(marbleAsBytes, &marbleToBuy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the offer only stands while the seller still owns the marble
+	if marbleToBuy.OwnerID != offerJSON.Seller {
+		return shim.Error("Marble " + marbleName + " is no longer owned by " + offerJSON.Seller)
+	}
+	err = checkNotLocked(&marbleToBuy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = changeOwner(stub, &marbleToBuy, offerJSON.Buyer, buyerID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	responsePayload := fmt.Sprintf("Bought %s from %s for %d", marbleName, offerJSON.Seller, offerJSON.Price)
+	fmt.Println("- end acceptOffer: " + responsePayload)
+	return shim.Success([]byte(responsePayload))
+}
+
+// ===========================================================================================
+// cancelOffer - the seller withdraws an offer, or the buyer declines it, before it is accepted.
+// Once an offer has expired anyone may cancel it to clear it out of state.
+// ===========================================================================================
+func (t *SimpleChaincode) cancelOffer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0         1
+	// "marble1", "Org1MSP/bob@org1.example.com"
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments. Expecting 2")
+	}
+
+	marbleName := args[0]
+	buyerID := args[1]
+	fmt.Println("- start cancelOffer ", marbleName, buyerID)
+
+	offerKey, offerJSON, err := getOffer(stub, marbleName, buyerID)
+	if err != nil {
+		return shim.Error("Failed to get offer:" + err.Error())
+	} else if offerJSON == nil {
+		return shim.Error("No offer of marble " + marbleName + " has been made to " + buyerID)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error("Failed to get transaction timestamp: " + err.Error())
+	}
+	expired, err := offerExpired(offerJSON, now)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller, err := callerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !expired && caller != offerJSON.Seller && caller != offerJSON.BuyerID {
+		admin, err := isAdmin(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !admin {
+			return shim.Error(caller + " is not a party to the offer")
+		}
+	}
+
+	err = delOffer(stub, offerKey, offerJSON)
+	if err != nil {
+		return shim.Error("Failed to delete state:" + err.Error())
+	}
+
+	fmt.Println("- end cancelOffer (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================================
+// queryOffersByOwner lists the offers an owner has made which have not expired, using a range
+// query against the offerSeller~seller~marble~buyer index. Available on any state database.
+// ===========================================================================================
+func (t *SimpleChaincode) queryOffersByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+
+	//   0
+	// "Org1MSP/bob@org1.example.com"
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments. Expecting 1")
+	}
+
+	seller := args[0]
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error("Failed to get transaction timestamp: " + err.Error())
+	}
+
+	offerResultsIterator, err := stub.GetStateByPartialCompositeKey(offerSellerIndex, []string{seller})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer offerResultsIterator.Close()
+
+	offers := []offer{}
+	for offerResultsIterator.HasNext() {
+		responseRange, err := offerResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the marble and buyer from the offerSeller~seller~marble~buyer composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, offerJSON, err := getOffer(stub, compositeKeyParts[1], compositeKeyParts[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if offerJSON == nil {
+			return shim.Error(fmt.Sprintf("Offer of marble %s to %s is indexed but does not exist", compositeKeyParts[1], compositeKeyParts[2]))
+		}
+		expired, err := offerExpired(offerJSON, now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !expired {
+			offers = append(offers, *offerJSON)
+		}
+	}
+
+	offersAsBytes, err := json.Marshal(offers)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	fmt.Printf("- queryOffersByOwner queryResult:\n%s\n", string(offersAsBytes))
+	return shim.Success(offersAsBytes)
+}
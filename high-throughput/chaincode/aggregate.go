@@ -0,0 +1,271 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Aggregation of delta rows. Each operator belongs to a family and a variable only accepts deltas of the
+ * family it was created with, additive unless declared otherwise, see config.go:
+ *	- additive, "+" and "-", the deltas are summed (counters, balances)
+ *	- multiplicative, "*" and "/", the deltas are multiplied starting from 1 (compounding factors)
+ *	- "max" and "min", the highest or lowest delta wins (high-water marks)
+ *	- "set", the delta with the latest transaction timestamp wins (gauges)
+ * The additive, multiplicative, max and min families are commutative so deltas may be folded in any order. "set" is not,
+ * so every delta row stores the timestamp of the transaction that wrote it and ties are broken on the txID.
+ * Values are folded as float64 unless the variable was created as a decimal variable, see config.go.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Composite key under which delta rows were stored before they were bucketed, see checkpoint.go
+const deltaIndex = "varName~op~value~txID"
+
+// Operator families
+const (
+	familyAdditive       = "additive"
+	familyMultiplicative = "multiplicative"
+	familyMax            = "max"
+	familyMin            = "min"
+	familySet            = "set"
+)
+
+/**
+ * Returns the family of an operator, or an empty string if the operator is unrecognized
+ *
+ * @param op The operator of a delta
+ *
+ * @return The operator family
+ */
+func opFamily(op string) string {
+	switch op {
+	case "+", "-":
+		return familyAdditive
+	case "*", "/":
+		return familyMultiplicative
+	case "max":
+		return familyMax
+	case "min":
+		return familyMin
+	case "set":
+		return familySet
+	}
+
+	return ""
+}
+
+/**
+ * Parses a float value. strconv.ParseFloat accepts "NaN" and "Inf", which would poison every later aggregate of
+ * the variable, so only finite values are accepted.
+ *
+ * @param value The value to parse
+ *
+ * @return The value, or an error if it is not a finite number
+ */
+func parseFloat(value string) (float64, error) {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		return 0, fmt.Errorf("Provided value %s was not a finite number", value)
+	}
+
+	return parsed, nil
+}
+
+// delta is a single parsed delta row
+type delta struct {
+	op string
+	// The value as recorded, parsed according to the variable's configuration when applied
+	value string
+	// Transaction timestamp in nanoseconds, 0 for rows written before timestamps were recorded
+	time int64
+	txID string
+}
+
+/**
+ * Parses a delta row back into its operation, value, timestamp and txID. The operation, value and txID are the
+ * last attributes of the key in both the bucketed and the original index.
+ *
+ * @param APIstub The chaincode shim
+ * @param key The composite key of the row
+ * @param rowValue The value stored in the row, the transaction timestamp
+ *
+ * @return The parsed delta
+ */
+func parseDelta(APIstub shim.ChaincodeStubInterface, key string, rowValue []byte) (delta, error) {
+	_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(key)
+	if splitKeyErr != nil {
+		return delta{}, splitKeyErr
+	}
+
+	// Rows written before timestamps were recorded hold a single 0x00 byte
+	txTime, timeErr := strconv.ParseInt(string(rowValue), 10, 64)
+	if timeErr != nil {
+		txTime = 0
+	}
+
+	n := len(keyParts)
+	return delta{op: keyParts[n-3], value: keyParts[n-2], time: txTime, txID: keyParts[n-1]}, nil
+}
+
+// aggregate is the running value of a variable while its deltas are folded in
+type aggregate struct {
+	config varConfig
+	family string
+	value  float64
+	// Value in units of the scale, used instead of value for decimal variables
+	units *big.Int
+	// Timestamp and txID of the winning "set" delta
+	setTime int64
+	setTxID string
+	rows    int
+	// Deltas left out because they would have lowered the value below the floor
+	violations []delta
+}
+
+/**
+ * Creates an empty aggregate for a variable
+ *
+ * @param config The configuration of the variable
+ *
+ * @return The aggregate
+ */
+func newAggregate(config varConfig) *aggregate {
+	return &aggregate{config: config, units: new(big.Int)}
+}
+
+/**
+ * Folds a delta into the aggregate
+ *
+ * @param d The delta to apply
+ *
+ * @return An error if the delta's operator is unrecognized, of a different family than previous deltas, or its
+ *         value cannot be parsed
+ */
+func (a *aggregate) apply(d delta) error {
+	family := opFamily(d.op)
+	if family == "" {
+		return fmt.Errorf("Unrecognized operation %s", d.op)
+	}
+	if a.rows > 0 && family != a.family {
+		return fmt.Errorf("Operation %s cannot be combined with the %s operations already recorded", d.op, a.family)
+	}
+
+	first := a.rows == 0
+	if a.config.decimal() {
+		units, parseErr := parseDecimal(d.value, a.config.Scale)
+		if parseErr != nil {
+			return parseErr
+		}
+		applyErr := a.applyDecimal(d, units, first)
+		if applyErr != nil {
+			return applyErr
+		}
+	} else {
+		value, convErr := parseFloat(d.value)
+		if convErr != nil {
+			return convErr
+		}
+		a.applyFloat(d, value, first)
+	}
+	a.family = family
+	a.rows++
+
+	return nil
+}
+
+/**
+ * Folds a float64 delta into the aggregate
+ *
+ * @param d The delta to apply
+ * @param value The parsed value of the delta
+ * @param first Whether this is the first delta folded
+ */
+func (a *aggregate) applyFloat(d delta, value float64, first bool) {
+	switch d.op {
+	case "+":
+		a.value += value
+	case "-":
+		a.value -= value
+	case "*":
+		if first {
+			a.value = 1
+		}
+		a.value *= value
+	case "/":
+		if first {
+			a.value = 1
+		}
+		a.value /= value
+	case "max":
+		if first || value > a.value {
+			a.value = value
+		}
+	case "min":
+		if first || value < a.value {
+			a.value = value
+		}
+	case "set":
+		if first || d.time > a.setTime || (d.time == a.setTime && d.txID > a.setTxID) {
+			a.value = value
+			a.setTime = d.time
+			a.setTxID = d.txID
+		}
+	}
+}
+
+/**
+ * Folds a decimal delta into the aggregate. Multiplicative deltas are not supported as their products would
+ * need more decimal places than the variable declares.
+ *
+ * @param d The delta to apply
+ * @param units The parsed value of the delta in units
+ * @param first Whether this is the first delta folded
+ *
+ * @return An error if the operator is not supported by decimal variables
+ */
+func (a *aggregate) applyDecimal(d delta, units *big.Int, first bool) error {
+	switch d.op {
+	case "+":
+		a.units.Add(a.units, units)
+	case "-":
+		a.units.Sub(a.units, units)
+	case "max":
+		if first || units.Cmp(a.units) > 0 {
+			a.units.Set(units)
+		}
+	case "min":
+		if first || units.Cmp(a.units) < 0 {
+			a.units.Set(units)
+		}
+	case "set":
+		if first || d.time > a.setTime || (d.time == a.setTime && d.txID > a.setTxID) {
+			a.units.Set(units)
+			a.setTime = d.time
+			a.setTxID = d.txID
+		}
+	default:
+		return fmt.Errorf("Operator %s is not supported by decimal variables", d.op)
+	}
+
+	return nil
+}
+
+/**
+ * Formats the aggregate value as stored in the ledger
+ *
+ * @return The value as a string
+ */
+func (a *aggregate) String() string {
+	if a.config.decimal() {
+		return formatDecimal(a.units, a.config.Scale)
+	}
+
+	return strconv.FormatFloat(a.value, 'f', -1, 64)
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Point-in-time reads. Every delta row is keyed by the bucket of its transaction timestamp and holds the
+ * timestamp itself, so the value of a variable as of a time is the value at the end of the previous bucket
+ * followed by the deltas of the time's own bucket up to that time. Checkpointing records the value at the
+ * end of every bucket with deltas it folds, as well as the value before the first one, and each checkpoint
+ * links to the one before it, so this holds after the deltas of earlier buckets have been pruned. Only a time
+ * within a bucket whose own deltas have been pruned cannot be answered. Rows recorded before timestamps were
+ * stored are treated as having been recorded at the start.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+/**
+ * Computes the value of a variable at a time within a checkpointed bucket from the checkpoint before the
+ * bucket, found by following the checkpoints back from the latest, and the bucket's own deltas
+ *
+ * @param APIstub The chaincode shim
+ * @param config The configuration of the variable
+ * @param floor The floor of the variable, nil if it has none
+ * @param name The name of the variable
+ * @param latest The latest checkpoint of the variable
+ * @param until The transaction timestamp in nanoseconds
+ *
+ * @return The aggregate, or an error if the bucket predates the variable or has been pruned
+ */
+func aggregateInCheckpoint(APIstub shim.ChaincodeStubInterface, config varConfig, floor *aggregate, name string, latest *checkpoint, until int64) (*aggregate, error) {
+	bucket := bucketOf(until)
+	if bucket < latest.First {
+		return nil, fmt.Errorf("Variable %s has no value before bucket %s", name, latest.First)
+	}
+
+	// Start from the value at the end of the previous bucket, i.e. of the latest checkpoint row before the bucket
+	start := latest
+	var checkpointed bool
+	for start.Bucket >= bucket {
+		checkpointed = checkpointed || start.Bucket == bucket
+		prev := start.Prev
+		if prev == "" {
+			return nil, fmt.Errorf("Variable %s has no checkpoint before bucket %s", name, bucket)
+		}
+		var startErr error
+		start, startErr = getCheckpoint(APIstub, checkpointIndex, []string{name, prev})
+		if startErr != nil {
+			return nil, startErr
+		}
+		if start == nil {
+			return nil, fmt.Errorf("Variable %s has no checkpoint for bucket %s", name, prev)
+		}
+	}
+
+	val, restoreErr := restoreAggregate(config, start)
+	if restoreErr != nil {
+		return nil, restoreErr
+	}
+
+	// A bucket without a checkpoint row of its own had no deltas when it was checkpointed
+	if !checkpointed {
+		return val, nil
+	}
+
+	// The bucket's own deltas must all still be there
+	_, cursor, cursorErr := getPruneCursor(APIstub, name)
+	if cursorErr != nil {
+		return nil, cursorErr
+	}
+	if cursor.Bucket != "" && (cursor.Bucket > bucket || cursor.Bucket == bucket && cursor.Partial) {
+		return nil, fmt.Errorf("Bucket %s of %s has been pruned, its value is only known at the end of the bucket", bucket, name)
+	}
+
+	foldErr := foldRows(APIstub, val, floor, deltaBucketIndex, []string{name, bucket}, until)
+	if foldErr != nil {
+		return nil, foldErr
+	}
+
+	return val, nil
+}
+
+/**
+ * Retrieves the aggregate value of a variable as it was at a point in time, i.e. of the deltas whose
+ * transaction timestamp is no later than that time. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable to get the value of
+ *	- args[1] -> The time, in RFC 3339 format, e.g. 2018-10-22T09:30:00Z
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getAt invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) getAt(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	at, parseErr := time.Parse(time.RFC3339Nano, args[1])
+	if parseErr != nil {
+		return shim.Error(fmt.Sprintf("Provided time was not in RFC 3339 format: %s", parseErr.Error()))
+	}
+
+	val, err := computeAggregateUntil(APIstub, name, at.UnixNano())
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(val.String()))
+}
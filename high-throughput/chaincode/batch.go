@@ -0,0 +1,118 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Bulk updates and reads. An application emitting many counters per event can record all of their deltas in a
+ * single transaction with updatebatch and read them back with getmany. Each delta is still its own row, so a
+ * batch conflicts with concurrent updates no more than the same deltas sent one update at a time. Deltas in a
+ * batch share the transaction ID, so each is recorded under the transaction ID suffixed with its position in
+ * the batch to keep their rows apart and in order.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Largest number of deltas a single updatebatch invocation may record
+const maxBatchUpdates = 1000
+
+// batchUpdate is a single delta of an updatebatch invocation
+type batchUpdate struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// batchValue is the value of a single variable returned by getmany
+type batchValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	// Why the value could not be computed, e.g. the variable does not exist
+	Error string `json:"error,omitempty"`
+}
+
+/**
+ * Records deltas for any number of variables in one transaction, with the same validation as update. If any
+ * delta is rejected the whole batch is. The args array contains the following argument:
+ *	- args[0] -> A JSON array of deltas, e.g. [{"name":"myvar","op":"+","value":"1"}]
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the updateBatch invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) updateBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	updates := []batchUpdate{}
+	unmarshalErr := json.Unmarshal([]byte(args[0]), &updates)
+	if unmarshalErr != nil {
+		return shim.Error(fmt.Sprintf("Could not read the batch of updates: %s", unmarshalErr.Error()))
+	}
+	if len(updates) == 0 {
+		return shim.Error("The batch of updates is empty")
+	}
+	if len(updates) > maxBatchUpdates {
+		return shim.Error(fmt.Sprintf("A batch may hold at most %d updates", maxBatchUpdates))
+	}
+
+	txid := APIstub.GetTxID()
+	for i, u := range updates {
+		recordErr := recordDelta(APIstub, u.Name, u.Op, u.Value, fmt.Sprintf("%s.%04d", txid, i))
+		if recordErr != nil {
+			return shim.Error(fmt.Sprintf("Update %d of the batch was rejected: %s", i, recordErr.Error()))
+		}
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully recorded %d updates", len(updates))))
+}
+
+/**
+ * Retrieves the aggregate values of a list of variables. A variable whose value cannot be computed is
+ * returned with an error rather than failing the whole query. The args array contains the following argument:
+ *	- args[0] -> A JSON array of variable names, e.g. ["myvar","othervar"]
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the getMany invocation
+ *
+ * @return A response structure with a JSON array of values in the order the names were given
+ */
+func (s *SmartContract) getMany(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	names := []string{}
+	unmarshalErr := json.Unmarshal([]byte(args[0]), &names)
+	if unmarshalErr != nil {
+		return shim.Error(fmt.Sprintf("Could not read the list of variables: %s", unmarshalErr.Error()))
+	}
+
+	results := []batchValue{}
+	for _, name := range names {
+		val, err := computeAggregate(APIstub, name)
+		if err != nil {
+			results = append(results, batchValue{Name: name, Error: err.Error()})
+			continue
+		}
+		results = append(results, batchValue{Name: name, Value: val.String()})
+	}
+
+	resultsBytes, marshalErr := json.Marshal(results)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+
+	return shim.Success(resultsBytes)
+}
@@ -0,0 +1,842 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Buckets and checkpoints. Every delta row is filed under the hour of its transaction timestamp, its bucket,
+ * and each update marks its bucket as pending. Once a bucket has closed, i.e. its hour and a grace period have
+ * passed, checkpoint folds it into a cumulative checkpoint row holding the value of the variable at the end of
+ * that bucket. get then starts from the latest checkpoint and only reads the pending buckets, so its cost
+ * depends on the number of deltas since the last checkpoint rather than on every delta ever recorded.
+ *
+ * An update reads the checkpoint row of its own bucket and is rejected if it exists. Checkpoints are only
+ * written for closed buckets, so this row does not change while updates are being submitted into the bucket.
+ * Should a late update race a checkpoint of its bucket, one of the two fails validation: either the update
+ * read a checkpoint row which has since been written, or the checkpoint's range over the bucket's deltas
+ * no longer matches. Checkpointing is therefore safe to run alongside updates.
+ *
+ * Checkpoint rows are only written for buckets with deltas, so an update into a bucket which was passed
+ * without any finds no row and is accepted. Its bucket stays pending and its deltas are folded into the next
+ * checkpoint, so they count towards the value from then on but not towards the values getat reports for the
+ * buckets in between.
+ *
+ * Rows recorded before buckets were introduced remain under the original "varName~op~value~txID" index and
+ * are folded in ahead of every bucket.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite keys under which bucketed delta rows, pending buckets and checkpoints are stored
+const (
+	deltaBucketIndex      = "varName~bucket~op~value~txID"
+	pendingBucketIndex    = "pending~varName~bucket"
+	checkpointIndex       = "checkpoint~varName~bucket"
+	latestCheckpointIndex = "latestCheckpoint~varName"
+	firstCheckpointIndex  = "firstCheckpoint~varName"
+)
+
+// Buckets are an hour of transaction timestamps, named by that hour in UTC so that they sort in time order
+const (
+	bucketWidth  = time.Hour
+	bucketLayout = "2006010215"
+)
+
+// How long after a bucket ends before it is considered closed, allowing for transactions in flight
+const checkpointGrace = 5 * time.Minute
+
+// Largest number of buckets a single checkpoint invocation folds, further invocations carry on from there
+const maxCheckpointBuckets = 24 * 7
+
+// checkpoint is the value of a variable at the end of a bucket
+type checkpoint struct {
+	Bucket  string `json:"bucket"`
+	Family  string `json:"family"`
+	Value   string `json:"value"`
+	SetTime int64  `json:"set_time"`
+	SetTxID string `json:"set_txid"`
+	Rows    int    `json:"rows"`
+	// First bucket the variable was checkpointed from
+	First string `json:"first"`
+	// Bucket of the previous checkpoint row, empty for the value before the first bucket. Rows are only
+	// written for buckets with deltas, the value at the end of any other bucket is that of the row before it
+	Prev string `json:"prev,omitempty"`
+	// Transaction and timestamp of the first update in a bucket, see registry.go
+	CreatedTxID string `json:"created_txid,omitempty"`
+	Created     int64  `json:"created,omitempty"`
+}
+
+/**
+ * Returns the bucket of a transaction timestamp
+ *
+ * @param txTime The transaction timestamp in nanoseconds
+ *
+ * @return The bucket name
+ */
+func bucketOf(txTime int64) string {
+	return time.Unix(0, txTime).UTC().Format(bucketLayout)
+}
+
+/**
+ * Returns the bucket following a bucket
+ *
+ * @param bucket The bucket name
+ *
+ * @return The name of the next bucket
+ */
+func nextBucket(bucket string) (string, error) {
+	start, parseErr := time.Parse(bucketLayout, bucket)
+	if parseErr != nil {
+		return "", fmt.Errorf("Invalid bucket %s: %s", bucket, parseErr.Error())
+	}
+
+	return start.Add(bucketWidth).Format(bucketLayout), nil
+}
+
+/**
+ * Returns the bucket preceding a bucket
+ *
+ * @param bucket The bucket name
+ *
+ * @return The name of the previous bucket
+ */
+func prevBucket(bucket string) (string, error) {
+	start, parseErr := time.Parse(bucketLayout, bucket)
+	if parseErr != nil {
+		return "", fmt.Errorf("Invalid bucket %s: %s", bucket, parseErr.Error())
+	}
+
+	return start.Add(-bucketWidth).Format(bucketLayout), nil
+}
+
+/**
+ * Reports whether a bucket has closed, i.e. no more updates are expected into it
+ *
+ * @param bucket The bucket name
+ * @param txTime The current transaction timestamp in nanoseconds
+ *
+ * @return True if the bucket and its grace period have ended
+ */
+func bucketClosed(bucket string, txTime int64) (bool, error) {
+	start, parseErr := time.Parse(bucketLayout, bucket)
+	if parseErr != nil {
+		return false, fmt.Errorf("Invalid bucket %s: %s", bucket, parseErr.Error())
+	}
+
+	return !start.Add(bucketWidth + checkpointGrace).After(time.Unix(0, txTime)), nil
+}
+
+/**
+ * Retrieves the timestamp of the current transaction in nanoseconds
+ *
+ * @param APIstub The chaincode shim
+ *
+ * @return The transaction timestamp
+ */
+func txTimeOf(APIstub shim.ChaincodeStubInterface) (int64, error) {
+	txTimestamp, timestampErr := APIstub.GetTxTimestamp()
+	if timestampErr != nil {
+		return 0, fmt.Errorf("Could not retrieve the transaction timestamp: %s", timestampErr.Error())
+	}
+
+	return txTimestamp.Seconds*int64(time.Second) + int64(txTimestamp.Nanos), nil
+}
+
+/**
+ * Captures the aggregate as the checkpoint of a bucket
+ *
+ * @param bucket The bucket the aggregate is the value at the end of
+ *
+ * @return The checkpoint
+ */
+func (a *aggregate) checkpoint(bucket string) checkpoint {
+	return checkpoint{Bucket: bucket, Family: a.family, Value: a.String(), SetTime: a.setTime, SetTxID: a.setTxID, Rows: a.rows}
+}
+
+/**
+ * Captures the aggregate as the checkpoint of a bucket following another checkpoint of the variable
+ *
+ * @param bucket The bucket the aggregate is the value at the end of
+ * @param prev The previous checkpoint
+ *
+ * @return The checkpoint
+ */
+func (a *aggregate) nextCheckpoint(bucket string, prev checkpoint) checkpoint {
+	cp := a.checkpoint(bucket)
+	cp.Prev = prev.Bucket
+	cp.First = prev.First
+	cp.CreatedTxID, cp.Created = prev.CreatedTxID, prev.Created
+
+	return cp
+}
+
+/**
+ * Restores an aggregate from a checkpoint
+ *
+ * @param config The configuration of the variable
+ * @param cp The checkpoint
+ *
+ * @return The aggregate
+ */
+func restoreAggregate(config varConfig, cp *checkpoint) (*aggregate, error) {
+	a := newAggregate(config)
+	a.family = cp.Family
+	a.setTime = cp.SetTime
+	a.setTxID = cp.SetTxID
+	a.rows = cp.Rows
+
+	if config.decimal() {
+		units, parseErr := parseDecimal(cp.Value, config.Scale)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		a.units = units
+	} else {
+		value, convErr := parseFloat(cp.Value)
+		if convErr != nil {
+			return nil, convErr
+		}
+		a.value = value
+	}
+
+	return a, nil
+}
+
+/**
+ * Retrieves a checkpoint row
+ *
+ * @param APIstub The chaincode shim
+ * @param index The index of the row, checkpointIndex or latestCheckpointIndex
+ * @param keys The attributes of the row's key
+ *
+ * @return The checkpoint or nil if the row does not exist
+ */
+func getCheckpoint(APIstub shim.ChaincodeStubInterface, index string, keys []string) (*checkpoint, error) {
+	checkpointKey, compositeErr := APIstub.CreateCompositeKey(index, keys)
+	if compositeErr != nil {
+		return nil, fmt.Errorf("Could not create a composite key for %s: %s", keys[0], compositeErr.Error())
+	}
+
+	checkpointBytes, getErr := APIstub.GetState(checkpointKey)
+	if getErr != nil {
+		return nil, fmt.Errorf("Could not retrieve the checkpoint of %s: %s", keys[0], getErr.Error())
+	}
+	if checkpointBytes == nil {
+		return nil, nil
+	}
+
+	cp := &checkpoint{}
+	unmarshalErr := json.Unmarshal(checkpointBytes, cp)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("Could not read the checkpoint of %s: %s", keys[0], unmarshalErr.Error())
+	}
+
+	return cp, nil
+}
+
+/**
+ * Stores a checkpoint row
+ *
+ * @param APIstub The chaincode shim
+ * @param index The index of the row, checkpointIndex or latestCheckpointIndex
+ * @param keys The attributes of the row's key
+ * @param cp The checkpoint
+ *
+ * @return An error if the row could not be stored
+ */
+func putCheckpoint(APIstub shim.ChaincodeStubInterface, index string, keys []string, cp checkpoint) error {
+	checkpointKey, compositeErr := APIstub.CreateCompositeKey(index, keys)
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", keys[0], compositeErr.Error())
+	}
+
+	checkpointBytes, marshalErr := json.Marshal(cp)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	checkpointPutErr := APIstub.PutState(checkpointKey, checkpointBytes)
+	if checkpointPutErr != nil {
+		return fmt.Errorf("Could not put the checkpoint of %s in the ledger: %s", keys[0], checkpointPutErr.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Folds the delta rows under a partial key into an aggregate. Deltas of a variable with a floor are sorted
+ * into timestamp order first.
+ *
+ * @param APIstub The chaincode shim
+ * @param a The aggregate to fold into
+ * @param floor The floor of the variable, nil if it has none
+ * @param index The index of the rows, deltaIndex or deltaBucketIndex
+ * @param keys The partial key of the rows
+ * @param until The transaction timestamp in nanoseconds after which deltas are left out
+ *
+ * @return An error if a row could not be read or applied
+ */
+func foldRows(APIstub shim.ChaincodeStubInterface, a *aggregate, floor *aggregate, index string, keys []string, until int64) error {
+	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(index, keys)
+	if deltaErr != nil {
+		return fmt.Errorf("Could not retrieve value for %s: %s", keys[0], deltaErr.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	var deltas []delta
+	for deltaResultsIterator.HasNext() {
+		responseRange, nextErr := deltaResultsIterator.Next()
+		if nextErr != nil {
+			return nextErr
+		}
+
+		// Retrieve the delta value, operation and timestamp
+		d, parseErr := parseDelta(APIstub, responseRange.Key, responseRange.Value)
+		if parseErr != nil {
+			return parseErr
+		}
+		if d.time > until {
+			continue
+		}
+
+		if floor != nil {
+			deltas = append(deltas, d)
+			continue
+		}
+
+		applyErr := a.apply(d)
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+
+	sortDeltas(deltas)
+	for _, d := range deltas {
+		applyErr := a.applyAboveFloor(d, floor)
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Retrieves the floor of a variable
+ *
+ * @param config The configuration of the variable
+ *
+ * @return The floor, or nil if the variable has none
+ */
+func floorOf(config varConfig) (*aggregate, error) {
+	if config.Floor == "" {
+		return nil, nil
+	}
+
+	return valueOf(config, config.Floor)
+}
+
+/**
+ * Checks whether an update may still be recorded into a bucket, which is not the case once the bucket has been
+ * checkpointed or lies before the first checkpointed bucket
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param bucket The bucket of the update
+ *
+ * @return An error if the bucket is closed to updates
+ */
+func checkBucketOpen(APIstub shim.ChaincodeStubInterface, name string, bucket string) error {
+	firstKey, compositeErr := APIstub.CreateCompositeKey(firstCheckpointIndex, []string{name})
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+	firstBytes, firstErr := APIstub.GetState(firstKey)
+	if firstErr != nil {
+		return fmt.Errorf("Could not retrieve the first checkpoint of %s: %s", name, firstErr.Error())
+	}
+
+	cp, checkpointErr := getCheckpoint(APIstub, checkpointIndex, []string{name, bucket})
+	if checkpointErr != nil {
+		return checkpointErr
+	}
+
+	if cp != nil || (firstBytes != nil && bucket < string(firstBytes)) {
+		return fmt.Errorf("Bucket %s of %s has already been checkpointed, the transaction timestamp is too old", bucket, name)
+	}
+
+	return nil
+}
+
+/**
+ * Retrieves the oldest pending bucket of a variable. Only that bucket's marker is read, later ones may still
+ * be receiving updates.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The bucket name, empty if the variable has no pending buckets
+ */
+func oldestPendingBucket(APIstub shim.ChaincodeStubInterface, name string) (string, error) {
+	pendingResultsIterator, pendingErr := APIstub.GetStateByPartialCompositeKey(pendingBucketIndex, []string{name})
+	if pendingErr != nil {
+		return "", fmt.Errorf("Could not retrieve pending buckets for %s: %s", name, pendingErr.Error())
+	}
+	defer pendingResultsIterator.Close()
+
+	if !pendingResultsIterator.HasNext() {
+		return "", nil
+	}
+	responseRange, nextErr := pendingResultsIterator.Next()
+	if nextErr != nil {
+		return "", nextErr
+	}
+	_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+	if splitKeyErr != nil {
+		return "", splitKeyErr
+	}
+
+	return keyParts[1], nil
+}
+
+/**
+ * Checkpoints a bucket and clears its pending marker
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param cp The checkpoint of the bucket
+ *
+ * @return An error if the checkpoint could not be stored
+ */
+func putBucketCheckpoint(APIstub shim.ChaincodeStubInterface, name string, cp checkpoint) error {
+	putErr := putCheckpoint(APIstub, checkpointIndex, []string{name, cp.Bucket}, cp)
+	if putErr != nil {
+		return putErr
+	}
+
+	// The bucket is no longer pending
+	pendingKey, compositeErr := APIstub.CreateCompositeKey(pendingBucketIndex, []string{name, cp.Bucket})
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+	pendingDelErr := APIstub.DelState(pendingKey)
+	if pendingDelErr != nil {
+		return fmt.Errorf("Could not delete pending bucket %s of %s: %s", cp.Bucket, name, pendingDelErr.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Folds every closed bucket of a variable into checkpoints, starting after the latest checkpoint. A checkpoint
+ * row is only written for a bucket with deltas, at most maxCheckpointBuckets of them per call. The last week of
+ * closed buckets is walked an hour at a time, older buckets and buckets which received an update after they
+ * were passed are found through their pending markers. Only the deltas of closed buckets are read, so updates
+ * into the current bucket do not conflict with the checkpoint.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The latest checkpoint, nil if the variable has none, and the number of buckets checkpointed
+ */
+func checkpointBuckets(APIstub shim.ChaincodeStubInterface, name string) (*checkpoint, int, error) {
+	config, _, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return nil, 0, configErr
+	}
+	floor, floorErr := floorOf(config)
+	if floorErr != nil {
+		return nil, 0, floorErr
+	}
+	txTime, timeErr := txTimeOf(APIstub)
+	if timeErr != nil {
+		return nil, 0, timeErr
+	}
+
+	// Carry on from the latest checkpoint, or from the oldest pending bucket
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return nil, 0, latestErr
+	}
+	var val *aggregate
+	var cp checkpoint
+	var start, oldest string
+	if latest != nil {
+		var restoreErr, nextErr error
+		val, restoreErr = restoreAggregate(config, latest)
+		if restoreErr != nil {
+			return nil, 0, restoreErr
+		}
+		cp = *latest
+		start, nextErr = nextBucket(latest.Bucket)
+		if nextErr != nil {
+			return nil, 0, nextErr
+		}
+	} else {
+		var pendingErr error
+		oldest, pendingErr = oldestPendingBucket(APIstub, name)
+		if pendingErr != nil {
+			return nil, 0, pendingErr
+		}
+		start = oldest
+		if start == "" {
+			// A variable only holding rows recorded before buckets were introduced is checkpointed at the latest
+			// closed bucket, so that those rows can be pruned in batches
+			legacyResultsIterator, legacyErr := APIstub.GetStateByPartialCompositeKey(deltaIndex, []string{name})
+			if legacyErr != nil {
+				return nil, 0, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, legacyErr.Error())
+			}
+			legacy := legacyResultsIterator.HasNext()
+			legacyResultsIterator.Close()
+			if !legacy {
+				return nil, 0, nil
+			}
+			start = bucketOf(txTime - int64(bucketWidth+checkpointGrace))
+		}
+
+		// Rows recorded before buckets were introduced precede every bucket, their value is checkpointed as the
+		// value before the first bucket so that every checkpointed bucket has a checkpoint before it, see asof.go
+		val = newAggregate(config)
+		foldErr := foldRows(APIstub, val, floor, deltaIndex, []string{name}, math.MaxInt64)
+		if foldErr != nil {
+			return nil, 0, foldErr
+		}
+		beforeBucket, prevErr := prevBucket(start)
+		if prevErr != nil {
+			return nil, 0, prevErr
+		}
+		cp = val.checkpoint(beforeBucket)
+		cp.First = start
+	}
+	before := cp
+
+	// Buckets more than a week before the latest closed bucket are found through their pending markers, so
+	// neither an idle variable nor a transaction timestamp far in the past leaves checkpoint walking empty
+	// hours. So are the buckets which received an update after they were passed without deltas, see
+	// checkBucketOpen, their deltas are folded into the next checkpoint.
+	horizon := bucketOf(txTime - int64(bucketWidth+checkpointGrace) - int64(maxCheckpointBuckets-1)*int64(bucketWidth))
+	bucket := start
+	if bucket < horizon {
+		bucket = horizon
+	}
+	var count int
+	var late bool
+	if latest != nil || start < horizon {
+		pendingResultsIterator, pendingErr := APIstub.GetStateByPartialCompositeKey(pendingBucketIndex, []string{name})
+		if pendingErr != nil {
+			return nil, 0, fmt.Errorf("Could not retrieve pending buckets for %s: %s", name, pendingErr.Error())
+		}
+		defer pendingResultsIterator.Close()
+
+		for count < maxCheckpointBuckets && pendingResultsIterator.HasNext() {
+			responseRange, nextErr := pendingResultsIterator.Next()
+			if nextErr != nil {
+				return nil, 0, nextErr
+			}
+			_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+			if splitKeyErr != nil {
+				return nil, 0, splitKeyErr
+			}
+			if keyParts[1] >= bucket {
+				break
+			}
+
+			foldErr := foldRows(APIstub, val, floor, deltaBucketIndex, []string{name, keyParts[1]}, math.MaxInt64)
+			if foldErr != nil {
+				return nil, 0, foldErr
+			}
+			if keyParts[1] <= cp.Bucket {
+				late = true
+				pendingDelErr := APIstub.DelState(responseRange.Key)
+				if pendingDelErr != nil {
+					return nil, 0, fmt.Errorf("Could not delete pending bucket %s of %s: %s", keyParts[1], name, pendingDelErr.Error())
+				}
+				continue
+			}
+
+			cp = val.nextCheckpoint(keyParts[1], cp)
+			putErr := putBucketCheckpoint(APIstub, name, cp)
+			if putErr != nil {
+				return nil, 0, putErr
+			}
+			count++
+		}
+	}
+
+	// The last week of closed buckets is walked an hour at a time, reading its pending markers would also read
+	// the marker of the bucket still receiving updates
+	legacyOnly := latest == nil && oldest == ""
+	for count < maxCheckpointBuckets {
+		closed, closedErr := bucketClosed(bucket, txTime)
+		if closedErr != nil {
+			return nil, 0, closedErr
+		}
+		if !closed {
+			break
+		}
+
+		folded := val.rows + len(val.violations)
+		foldErr := foldRows(APIstub, val, floor, deltaBucketIndex, []string{name, bucket}, math.MaxInt64)
+		if foldErr != nil {
+			return nil, 0, foldErr
+		}
+		if val.rows+len(val.violations) > folded || (legacyOnly && count == 0) {
+			cp = val.nextCheckpoint(bucket, cp)
+			putErr := putBucketCheckpoint(APIstub, name, cp)
+			if putErr != nil {
+				return nil, 0, putErr
+			}
+			count++
+		}
+
+		var nextErr error
+		bucket, nextErr = nextBucket(bucket)
+		if nextErr != nil {
+			return nil, 0, nextErr
+		}
+	}
+
+	// Late deltas with no later bucket to checkpoint are folded into the checkpoint of the latest bucket
+	if count == 0 && late {
+		latestBucket := val.checkpoint(cp.Bucket)
+		latestBucket.Prev, latestBucket.First = cp.Prev, cp.First
+		latestBucket.CreatedTxID, latestBucket.Created = cp.CreatedTxID, cp.Created
+		cp = latestBucket
+		putErr := putCheckpoint(APIstub, checkpointIndex, []string{name, cp.Bucket}, cp)
+		if putErr != nil {
+			return nil, 0, putErr
+		}
+		count++
+	}
+	if count == 0 {
+		return latest, 0, nil
+	}
+
+	// The first update of the variable lies in a bucket which has now been checkpointed, so it is recorded
+	// before pruning can delete it
+	if latest == nil && oldest != "" {
+		var firstErr error
+		cp.CreatedTxID, cp.Created, firstErr = firstUpdate(APIstub, name, oldest)
+		if firstErr != nil {
+			return nil, 0, firstErr
+		}
+	}
+
+	// Keep a record of the deltas left out of the value, they are not read again
+	violationErr := recordViolations(APIstub, name, val.violations)
+	if violationErr != nil {
+		return nil, 0, violationErr
+	}
+
+	latestPutErr := putCheckpoint(APIstub, latestCheckpointIndex, []string{name}, cp)
+	if latestPutErr != nil {
+		return nil, 0, latestPutErr
+	}
+	if latest == nil {
+		firstKey, compositeErr := APIstub.CreateCompositeKey(firstCheckpointIndex, []string{name})
+		if compositeErr != nil {
+			return nil, 0, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+		}
+		firstPutErr := APIstub.PutState(firstKey, []byte(before.First))
+		if firstPutErr != nil {
+			return nil, 0, fmt.Errorf("Could not put the first checkpoint of %s in the ledger: %s", name, firstPutErr.Error())
+		}
+
+		beforePutErr := putCheckpoint(APIstub, checkpointIndex, []string{name, before.Bucket}, before)
+		if beforePutErr != nil {
+			return nil, 0, beforePutErr
+		}
+	}
+
+	return &cp, count, nil
+}
+
+/**
+ * Folds every closed bucket of a variable into checkpoints, starting after the latest checkpoint, see
+ * checkpointBuckets. The args array contains the following argument:
+ *	- args[0] -> The name of the variable to checkpoint
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the checkpoint invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) checkpoint(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	latest, count, err := checkpointBuckets(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if count == 0 {
+		return shim.Success([]byte(fmt.Sprintf("Variable %s has no closed buckets to checkpoint", name)))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully checkpointed %s up to bucket %s, value is %s, %d buckets checkpointed", name, latest.Bucket, latest.Value, count)))
+}
+
+/**
+ * Computes the value of a variable from its latest checkpoint and its pending buckets, or from all of its rows
+ * if it has not been checkpointed yet
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The aggregate, or an error if the variable does not exist or a row could not be processed
+ */
+func computeAggregate(APIstub shim.ChaincodeStubInterface, name string) (*aggregate, error) {
+	return computeAggregateUntil(APIstub, name, math.MaxInt64)
+}
+
+/**
+ * Computes the value of a variable as it was at a transaction timestamp, leaving out later deltas. A timestamp
+ * within a checkpointed bucket is computed from the checkpoint before that bucket, see asof.go.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param until The transaction timestamp in nanoseconds
+ *
+ * @return The aggregate, or an error if the variable does not exist or a row could not be processed
+ */
+func computeAggregateUntil(APIstub shim.ChaincodeStubInterface, name string, until int64) (*aggregate, error) {
+	// Get the configuration the deltas are folded with
+	config, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return nil, configErr
+	}
+	floor, floorErr := floorOf(config)
+	if floorErr != nil {
+		return nil, floorErr
+	}
+
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return nil, latestErr
+	}
+	untilBucket := bucketOf(until)
+	if latest != nil && latest.Bucket >= untilBucket {
+		return aggregateInCheckpoint(APIstub, config, floor, name, latest, until)
+	}
+
+	var finalVal *aggregate
+	if latest != nil {
+		var restoreErr error
+		finalVal, restoreErr = restoreAggregate(config, latest)
+		if restoreErr != nil {
+			return nil, restoreErr
+		}
+	} else {
+		finalVal = newAggregate(config)
+		foldErr := foldRows(APIstub, finalVal, floor, deltaIndex, []string{name}, until)
+		if foldErr != nil {
+			return nil, foldErr
+		}
+	}
+
+	// Fold in the buckets which have not been checkpointed, including any updated after they were passed
+	pendingResultsIterator, pendingErr := APIstub.GetStateByPartialCompositeKey(pendingBucketIndex, []string{name})
+	if pendingErr != nil {
+		return nil, fmt.Errorf("Could not retrieve pending buckets for %s: %s", name, pendingErr.Error())
+	}
+	defer pendingResultsIterator.Close()
+	for pendingResultsIterator.HasNext() {
+		responseRange, nextErr := pendingResultsIterator.Next()
+		if nextErr != nil {
+			return nil, nextErr
+		}
+		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+		if splitKeyErr != nil {
+			return nil, splitKeyErr
+		}
+		if keyParts[1] > untilBucket {
+			break
+		}
+
+		foldErr := foldRows(APIstub, finalVal, floor, deltaBucketIndex, []string{name, keyParts[1]}, until)
+		if foldErr != nil {
+			return nil, foldErr
+		}
+	}
+
+	// Check the variable existed, a created variable without updates is at 0
+	if !declared && latest == nil && finalVal.rows+len(finalVal.violations) == 0 {
+		return nil, fmt.Errorf("No variable by the name %s exists", name)
+	}
+
+	return finalVal, nil
+}
+
+/**
+ * Reports whether a variable has any delta rows, bucketed or recorded before buckets were introduced
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return True if at least one delta row exists
+ */
+func hasDeltas(APIstub shim.ChaincodeStubInterface, name string) (bool, error) {
+	for _, index := range []string{deltaIndex, deltaBucketIndex} {
+		deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(index, []string{name})
+		if deltaErr != nil {
+			return false, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error())
+		}
+		found := deltaResultsIterator.HasNext()
+		deltaResultsIterator.Close()
+		if found {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+/**
+ * Deletes every delta row of a variable together with its pending buckets, checkpoints and prune cursor
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The number of delta rows deleted
+ */
+func deleteRows(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	var deleted int
+	for _, index := range []string{deltaIndex, deltaBucketIndex, pendingBucketIndex, checkpointIndex, latestCheckpointIndex, firstCheckpointIndex, pruneCursorIndex} {
+		rowResultsIterator, rowErr := APIstub.GetStateByPartialCompositeKey(index, []string{name})
+		if rowErr != nil {
+			return deleted, fmt.Errorf("Could not retrieve rows for %s: %s", name, rowErr.Error())
+		}
+
+		for rowResultsIterator.HasNext() {
+			responseRange, nextErr := rowResultsIterator.Next()
+			if nextErr != nil {
+				rowResultsIterator.Close()
+				return deleted, fmt.Errorf("Could not retrieve next row: %s", nextErr.Error())
+			}
+
+			rowDelErr := APIstub.DelState(responseRange.Key)
+			if rowDelErr != nil {
+				rowResultsIterator.Close()
+				return deleted, fmt.Errorf("Could not delete row: %s", rowDelErr.Error())
+			}
+			if index == deltaIndex || index == deltaBucketIndex {
+				deleted++
+			}
+		}
+		rowResultsIterator.Close()
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Per-variable configuration. Variables are created implicitly by their first update and default to
+ * float64 arithmetic and the additive operators. A variable can instead be declared up front with create, which records its
+ * configuration in a single row. That row is written once and only read afterwards, so reading it on every
+ * update does not reintroduce the version conflicts the delta rows avoid.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key under which variable configurations are stored
+const configIndex = "config~varName"
+
+// Arithmetic modes of a variable
+const (
+	modeFloat   = "float"
+	modeDecimal = "decimal"
+)
+
+// Largest number of decimal places a decimal variable may declare
+const maxScale = 18
+
+// varConfig is the configuration of a variable
+type varConfig struct {
+	Mode string `json:"mode"`
+	// Number of decimal places of a decimal variable
+	Scale int `json:"scale"`
+	// Lowest value the variable may reach, empty if unbounded, see floor.go
+	Floor string `json:"floor,omitempty"`
+	// Operator family the variable accepts, empty for additive, see aggregate.go
+	Family string `json:"family,omitempty"`
+}
+
+/**
+ * Reports whether the variable uses exact decimal arithmetic
+ *
+ * @return True for decimal variables
+ */
+func (c varConfig) decimal() bool {
+	return c.Mode == modeDecimal
+}
+
+/**
+ * Returns the operator family the variable accepts
+ *
+ * @return The operator family
+ */
+func (c varConfig) family() string {
+	if c.Family == "" {
+		return familyAdditive
+	}
+	return c.Family
+}
+
+/**
+ * Checks a delta value and operator against the variable's configuration. Deltas of another operator family
+ * than the variable's are rejected here, as they could not be aggregated with the deltas already recorded.
+ *
+ * @param op The operator of the delta
+ * @param value The delta value as given by the client
+ *
+ * @return An error describing why the delta is not acceptable
+ */
+func (c varConfig) validate(op string, value string) error {
+	if opFamily(op) != c.family() {
+		return fmt.Errorf("Operator %s is not accepted by %s variables", op, c.family())
+	}
+
+	if !c.decimal() {
+		parsed, err := parseFloat(value)
+		if err != nil {
+			return err
+		}
+		if op == "/" && parsed == 0 {
+			return fmt.Errorf("Cannot divide by zero")
+		}
+		return nil
+	}
+
+	if opFamily(op) == familyMultiplicative {
+		return fmt.Errorf("Operator %s is not supported by decimal variables", op)
+	}
+	_, err := parseDecimal(value, c.Scale)
+	return err
+}
+
+/**
+ * Retrieves the configuration of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The configuration, whether the variable was declared with create, or an error
+ */
+func getVarConfig(APIstub shim.ChaincodeStubInterface, name string) (varConfig, bool, error) {
+	config := varConfig{Mode: modeFloat}
+
+	configKey, compositeErr := APIstub.CreateCompositeKey(configIndex, []string{name})
+	if compositeErr != nil {
+		return config, false, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+
+	configBytes, getErr := APIstub.GetState(configKey)
+	if getErr != nil {
+		return config, false, fmt.Errorf("Could not retrieve the configuration of %s: %s", name, getErr.Error())
+	}
+	if configBytes == nil {
+		return config, false, nil
+	}
+
+	unmarshalErr := json.Unmarshal(configBytes, &config)
+	if unmarshalErr != nil {
+		return config, false, fmt.Errorf("Could not read the configuration of %s: %s", name, unmarshalErr.Error())
+	}
+
+	return config, true, nil
+}
+
+/**
+ * Declares a variable before its first update, fixing its arithmetic. The args array contains the following
+ * arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The arithmetic mode, "float" or "decimal"
+ *	- args[2] -> The number of decimal places, required for decimal variables and empty for float variables
+ *	- args[3] -> Optional, the lowest value the variable may reach, e.g. 0 for a balance
+ *	- args[4] -> Optional, the operator family the variable accepts, "additive" (the default, also if empty),
+ *	             "multiplicative", "max", "min" or "set"
+ *
+ * Decimal variables are parsed, summed and pruned exactly and reject deltas with more decimal places than
+ * their scale. They do not support the multiplicative family.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the create invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) create(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) < 2 || len(args) > 5 {
+		return shim.Error("Incorrect number of arguments, expecting between 2 and 5")
+	}
+
+	name := args[0]
+	config := varConfig{Mode: args[1]}
+	switch config.Mode {
+	case modeFloat:
+		if len(args) >= 3 && args[2] != "" {
+			return shim.Error("Float variables do not take a scale")
+		}
+	case modeDecimal:
+		if len(args) < 3 {
+			return shim.Error("Decimal variables require a scale")
+		}
+		scale, convErr := strconv.Atoi(args[2])
+		if convErr != nil || scale < 0 || scale > maxScale {
+			return shim.Error(fmt.Sprintf("Scale must be a whole number between 0 and %d", maxScale))
+		}
+		config.Scale = scale
+	default:
+		return shim.Error(fmt.Sprintf("Mode %s is unrecognized", config.Mode))
+	}
+	// An empty family is the default, as the invoke script always passes one
+	if len(args) == 5 && args[4] != "" && args[4] != familyAdditive {
+		switch args[4] {
+		case familyMultiplicative:
+			if config.decimal() {
+				return shim.Error("Decimal variables do not support the multiplicative family")
+			}
+		case familyMax, familyMin, familySet:
+		default:
+			return shim.Error(fmt.Sprintf("Operator family %s is unrecognized", args[4]))
+		}
+		config.Family = args[4]
+	}
+	if len(args) >= 4 && args[3] != "" {
+		floorErr := varConfig{Mode: config.Mode, Scale: config.Scale}.validate("+", args[3])
+		if floorErr != nil {
+			return shim.Error(fmt.Sprintf("Invalid floor: %s", floorErr.Error()))
+		}
+		config.Floor = args[3]
+	}
+
+	// A variable's arithmetic cannot change once it exists
+	_, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
+	}
+	if declared {
+		return shim.Error(fmt.Sprintf("Variable %s has already been created", name))
+	}
+
+	updated, deltaErr := hasDeltas(APIstub, name)
+	if deltaErr != nil {
+		return shim.Error(deltaErr.Error())
+	}
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return shim.Error(latestErr.Error())
+	}
+	if updated || latest != nil {
+		return shim.Error(fmt.Sprintf("Variable %s already has updates", name))
+	}
+
+	configKey, compositeErr := APIstub.CreateCompositeKey(configIndex, []string{name})
+	if compositeErr != nil {
+		return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, compositeErr.Error()))
+	}
+	configBytes, marshalErr := json.Marshal(config)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+	configPutErr := APIstub.PutState(configKey, configBytes)
+	if configPutErr != nil {
+		return shim.Error(fmt.Sprintf("Could not put the configuration of %s in the ledger: %s", name, configPutErr.Error()))
+	}
+
+	// Register the variable, see registry.go
+	txTime, timeErr := txTimeOf(APIstub)
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+	registerErr := putRegistration(APIstub, name, registration{Declared: true, TxID: APIstub.GetTxID(), Time: txTime})
+	if registerErr != nil {
+		return shim.Error(registerErr.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully created %s variable %s", config.Mode, name)))
+}
@@ -0,0 +1,417 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Compares the delta rows of update with the single row of putstandard under contention. A block of concurrent
+ * transactions is endorsed against the same committed state, as peers do while the block is being cut, and
+ * then validated in order: a transaction only commits if every key it read still has the version it read and
+ * every range it read still holds the same keys. This is the MVCC and phantom read check Fabric performs, so
+ * the commit rates below are those of transactions submitted at the same time, e.g. by many-updates.sh and
+ * many-updates-traditional.sh. Each run covers three hours of blocks with a get after every block, and the mean
+ * number of keys those gets read shows what the deltas cost until pruned.
+ *
+ * Run the benchmarks with: go test -run XXX -bench Contention
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Time between blocks
+const blockInterval = time.Minute
+
+// mvccLedger is the committed state shared by the endorsements of a block, with the version of every key
+type mvccLedger struct {
+	stub     *shim.MockStub
+	versions map[string]uint64
+	txs      int
+}
+
+// rangeRead is a range of keys read by a transaction, as far as it iterated
+type rangeRead struct {
+	objectType string
+	attributes []string
+	keys       []string
+	versions   []uint64
+	exhausted  bool
+}
+
+// write is a buffered write of a transaction, a nil value deletes the key
+type write struct {
+	value []byte
+}
+
+// mvccStub simulates a single transaction. Reads see the committed state only and are recorded with their
+// versions, writes are buffered until the transaction is committed.
+type mvccStub struct {
+	*shim.MockStub
+	ledger   *mvccLedger
+	txID     string
+	function string
+	args     []string
+	txTime   time.Time
+	reads    map[string]uint64
+	ranges   []*rangeRead
+	writes   map[string]write
+	keysRead int
+}
+
+// mvccIterator hands out the results of a range query, recording each key as it is read
+type mvccIterator struct {
+	results []*queryresult.KV
+	read    *rangeRead
+	ledger  *mvccLedger
+	stub    *mvccStub
+}
+
+func newLedger() *mvccLedger {
+	return &mvccLedger{stub: shim.NewMockStub("high-throughput", new(SmartContract)), versions: map[string]uint64{}}
+}
+
+func (s *mvccStub) GetTxID() string {
+	return s.txID
+}
+
+func (s *mvccStub) GetFunctionAndParameters() (string, []string) {
+	return s.function, s.args
+}
+
+func (s *mvccStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.txTime.Unix(), Nanos: int32(s.txTime.Nanosecond())}, nil
+}
+
+func (s *mvccStub) GetState(key string) ([]byte, error) {
+	s.reads[key] = s.ledger.versions[key]
+	s.keysRead++
+	return s.ledger.stub.State[key], nil
+}
+
+func (s *mvccStub) PutState(key string, value []byte) error {
+	s.writes[key] = write{value: value}
+	return nil
+}
+
+func (s *mvccStub) DelState(key string) error {
+	s.writes[key] = write{}
+	return nil
+}
+
+func (s *mvccStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	results, err := s.ledger.rangeOf(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	read := &rangeRead{objectType: objectType, attributes: attributes}
+	s.ranges = append(s.ranges, read)
+	return &mvccIterator{results: results, read: read, ledger: s.ledger, stub: s}, nil
+}
+
+func (it *mvccIterator) HasNext() bool {
+	if len(it.results) == 0 {
+		it.read.exhausted = true
+		return false
+	}
+	return true
+}
+
+func (it *mvccIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("No more results")
+	}
+
+	kv := it.results[0]
+	it.results = it.results[1:]
+	it.read.keys = append(it.read.keys, kv.Key)
+	it.read.versions = append(it.read.versions, it.ledger.versions[kv.Key])
+	it.stub.keysRead++
+	return kv, nil
+}
+
+func (it *mvccIterator) Close() error {
+	return nil
+}
+
+// rangeOf reads every committed key under a partial composite key
+func (l *mvccLedger) rangeOf(objectType string, attributes []string) ([]*queryresult.KV, error) {
+	iterator, err := l.stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var results []*queryresult.KV
+	for iterator.HasNext() {
+		kv, nextErr := iterator.Next()
+		if nextErr != nil {
+			return nil, nextErr
+		}
+		results = append(results, kv)
+	}
+
+	return results, nil
+}
+
+// endorse simulates a transaction against the committed state
+func (l *mvccLedger) endorse(txTime time.Time, function string, args ...string) (*mvccStub, sc.Response) {
+	l.txs++
+	s := &mvccStub{
+		MockStub: l.stub,
+		ledger:   l,
+		txID:     fmt.Sprintf("tx%08d", l.txs),
+		function: function,
+		args:     args,
+		txTime:   txTime,
+		reads:    map[string]uint64{},
+		writes:   map[string]write{},
+	}
+
+	return s, new(SmartContract).Invoke(s)
+}
+
+// valid reports whether a transaction passes MVCC and phantom read validation against the committed state
+func (l *mvccLedger) valid(s *mvccStub) bool {
+	for key, version := range s.reads {
+		if l.versions[key] != version {
+			return false
+		}
+	}
+
+	for _, read := range s.ranges {
+		results, err := l.rangeOf(read.objectType, read.attributes)
+		if err != nil {
+			return false
+		}
+
+		// Only the part of the range the transaction iterated through is checked
+		var keys []string
+		for _, kv := range results {
+			if !read.exhausted && (len(read.keys) == 0 || kv.Key > read.keys[len(read.keys)-1]) {
+				break
+			}
+			keys = append(keys, kv.Key)
+		}
+		if len(keys) != len(read.keys) {
+			return false
+		}
+		for i, key := range keys {
+			if key != read.keys[i] || l.versions[key] != read.versions[i] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// commit validates a transaction and applies its writes if it is valid
+func (l *mvccLedger) commit(s *mvccStub) bool {
+	if !l.valid(s) {
+		return false
+	}
+
+	l.stub.MockTransactionStart(s.txID)
+	defer l.stub.MockTransactionEnd(s.txID)
+	keys := make([]string, 0, len(s.writes))
+	for key := range s.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if s.writes[key].value == nil {
+			l.stub.DelState(key)
+		} else {
+			l.stub.PutState(key, s.writes[key].value)
+		}
+		l.versions[key]++
+	}
+
+	return true
+}
+
+// block endorses n concurrent transactions against the same state and commits them in order, returning how
+// many were committed
+func (l *mvccLedger) block(t testing.TB, blockTime time.Time, n int, function string, args func(i int) []string) int {
+	endorsed := make([]*mvccStub, 0, n)
+	for i := 0; i < n; i++ {
+		s, resp := l.endorse(blockTime.Add(time.Duration(i)), function, args(i)...)
+		if resp.Status != shim.OK {
+			t.Fatalf("Endorsement of %s failed: %s", function, resp.Message)
+		}
+		endorsed = append(endorsed, s)
+	}
+
+	committed := 0
+	for _, s := range endorsed {
+		if l.commit(s) {
+			committed++
+		}
+	}
+
+	return committed
+}
+
+// invoke endorses and commits a single transaction, failing the test if either fails
+func (l *mvccLedger) invoke(t testing.TB, txTime time.Time, function string, args ...string) (*mvccStub, string) {
+	s, resp := l.endorse(txTime, function, args...)
+	if resp.Status != shim.OK {
+		t.Fatalf("%s %v failed: %s", function, args, resp.Message)
+	}
+	if !l.commit(s) {
+		t.Fatalf("%s %v failed validation", function, args)
+	}
+
+	return s, resp.Message + string(resp.Payload)
+}
+
+func TestConcurrentUpdatesCommit(t *testing.T) {
+	l := newLedger()
+	start := time.Date(2018, 10, 22, 9, 30, 0, 0, time.UTC)
+
+	committed := l.block(t, start, 10, "update", func(i int) []string { return []string{"myvar", "1", "+"} })
+	if committed != 10 {
+		t.Fatalf("Expected all 10 updates to commit, %d did", committed)
+	}
+
+	committed = l.block(t, start, 10, "putstandard", func(i int) []string { return []string{"myvar", strconv.Itoa(i)} })
+	if committed != 1 {
+		t.Fatalf("Expected a single putstandard to commit, %d did", committed)
+	}
+
+	_, value := l.invoke(t, start, "get", "myvar")
+	if value != "10" {
+		t.Fatalf("Expected myvar to be 10, got %s", value)
+	}
+}
+
+func TestPruneDoesNotConflictWithUpdates(t *testing.T) {
+	l := newLedger()
+	start := time.Date(2018, 10, 22, 9, 30, 0, 0, time.UTC)
+	l.block(t, start, 10, "update", func(i int) []string { return []string{"myvar", "1", "+"} })
+
+	// A prune endorsed alongside updates into the current bucket
+	now := start.Add(2 * time.Hour)
+	prune, resp := l.endorse(now, "prunefast", "myvar")
+	if resp.Status != shim.OK {
+		t.Fatalf("prunefast failed: %s", resp.Message)
+	}
+	committed := l.block(t, now, 10, "update", func(i int) []string { return []string{"myvar", "1", "+"} })
+	if committed != 10 {
+		t.Fatalf("Expected all 10 updates to commit, %d did", committed)
+	}
+	if !l.commit(prune) {
+		t.Fatalf("Expected prunefast to commit after concurrent updates to the current bucket")
+	}
+
+	_, value := l.invoke(t, now, "get", "myvar")
+	if value != "20" {
+		t.Fatalf("Expected myvar to be 20, got %s", value)
+	}
+}
+
+func TestReserveConflictsWithUpdates(t *testing.T) {
+	l := newLedger()
+	start := time.Date(2018, 10, 22, 9, 30, 0, 0, time.UTC)
+	l.invoke(t, start, "create", "balance", "decimal", "2", "0")
+	l.invoke(t, start, "update", "balance", "100", "+")
+
+	reserve, resp := l.endorse(start, "reserve", "balance", "50")
+	if resp.Status != shim.OK {
+		t.Fatalf("reserve failed: %s", resp.Message)
+	}
+	l.invoke(t, start, "update", "balance", "10", "-")
+	if l.commit(reserve) {
+		t.Fatalf("Expected reserve to fail validation after a concurrent update")
+	}
+}
+
+// Blocks committed per run, three hours so that buckets close and hourly pruning has something to prune
+const contentionBlocks = int(3 * time.Hour / blockInterval)
+
+// runContention commits a run of blocks of n concurrent transactions against a new ledger, reading the variable
+// after each block. It returns the number of transactions committed and the keys read by all the reads.
+func runContention(tb testing.TB, n int, function string, args func(i int) []string, read string, pruneEvery int) (int, int) {
+	l := newLedger()
+	start := time.Date(2018, 10, 22, 0, 0, 0, 0, time.UTC)
+
+	committed := 0
+	reads := 0
+	for i := 0; i < contentionBlocks; i++ {
+		blockTime := start.Add(time.Duration(i) * blockInterval)
+		committed += l.block(tb, blockTime, n, function, args)
+
+		if pruneEvery > 0 && (i+1)%pruneEvery == 0 {
+			l.invoke(tb, blockTime, "prunefast", "myvar")
+		}
+
+		s, resp := l.endorse(blockTime, read, "myvar")
+		if resp.Status != shim.OK {
+			tb.Fatalf("%s failed: %s", read, resp.Message)
+		}
+		reads += s.keysRead
+	}
+
+	return committed, reads
+}
+
+// benchmarkContention performs b.N runs, reporting the share of transactions committed and the mean number of
+// keys read per read, which it returns
+func benchmarkContention(b *testing.B, n int, function string, args func(i int) []string, read string, pruneEvery int) float64 {
+	committed := 0
+	reads := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runCommitted, runReads := runContention(b, n, function, args, read, pruneEvery)
+		committed += runCommitted
+		reads += runReads
+	}
+
+	meanReads := float64(reads) / float64(b.N*contentionBlocks)
+	b.ReportMetric(float64(committed)/float64(b.N*contentionBlocks*n), "committed/tx")
+	b.ReportMetric(meanReads, "reads/get")
+
+	return meanReads
+}
+
+func TestHourlyPruneReducesReads(t *testing.T) {
+	update := func(i int) []string { return []string{"myvar", "1", "+"} }
+
+	_, reads := runContention(t, 10, "update", update, "get", 0)
+	_, prunedReads := runContention(t, 10, "update", update, "get", int(time.Hour/blockInterval))
+	if prunedReads >= reads {
+		t.Fatalf("Expected gets to read fewer keys with hourly pruning, read %d keys against %d", prunedReads, reads)
+	}
+}
+
+func BenchmarkContention(b *testing.B) {
+	update := func(i int) []string { return []string{"myvar", "1", "+"} }
+	putStandard := func(i int) []string { return []string{"myvar", strconv.Itoa(i)} }
+
+	for _, n := range []int{1, 10, 100} {
+		var reads, prunedReads float64
+		b.Run(fmt.Sprintf("update/%d", n), func(b *testing.B) {
+			reads = benchmarkContention(b, n, "update", update, "get", 0)
+		})
+		b.Run(fmt.Sprintf("update-prune-hourly/%d", n), func(b *testing.B) {
+			prunedReads = benchmarkContention(b, n, "update", update, "get", int(time.Hour/blockInterval))
+		})
+		if prunedReads >= reads {
+			b.Fatalf("Expected gets to read fewer keys with hourly pruning, %.1f per get against %.1f", prunedReads, reads)
+		}
+		b.Run(fmt.Sprintf("putstandard/%d", n), func(b *testing.B) {
+			benchmarkContention(b, n, "putstandard", putStandard, "getstandard", 0)
+		})
+	}
+}
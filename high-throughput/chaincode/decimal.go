@@ -0,0 +1,102 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Exact decimal values. A decimal variable with scale s holds its value as an integer count of 10^-s units,
+ * so "12.34" at scale 2 is held as 1234. Sums of such integers are exact however many deltas are folded,
+ * unlike float64 where e.g. ten deltas of 0.1 do not add up to 1.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+/**
+ * Parses a plain decimal string, e.g. "-12.34", into units of the given scale
+ *
+ * @param value The decimal string
+ * @param scale The number of decimal places of the variable
+ *
+ * @return The value in units, or an error if the string is not a plain decimal or has more decimal places than the scale
+ */
+func parseDecimal(value string, scale int) (*big.Int, error) {
+	digits := value
+	negative := false
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	whole := digits
+	fraction := ""
+	if point := strings.IndexByte(digits, '.'); point >= 0 {
+		whole = digits[:point]
+		fraction = digits[point+1:]
+		if len(fraction) == 0 {
+			return nil, fmt.Errorf("Provided value %s was not a decimal number", value)
+		}
+	}
+	if len(whole) == 0 || !isDigits(whole) || !isDigits(fraction) {
+		return nil, fmt.Errorf("Provided value %s was not a decimal number", value)
+	}
+	if len(fraction) > scale {
+		return nil, fmt.Errorf("Provided value %s has more than %d decimal places", value, scale)
+	}
+
+	units, ok := new(big.Int).SetString(whole+fraction+strings.Repeat("0", scale-len(fraction)), 10)
+	if !ok {
+		return nil, fmt.Errorf("Provided value %s was not a decimal number", value)
+	}
+	if negative {
+		units.Neg(units)
+	}
+
+	return units, nil
+}
+
+/**
+ * Formats units of the given scale as a decimal string with exactly scale decimal places
+ *
+ * @param units The value in units
+ * @param scale The number of decimal places of the variable
+ *
+ * @return The decimal string
+ */
+func formatDecimal(units *big.Int, scale int) string {
+	digits := new(big.Int).Abs(units).String()
+	if len(digits) <= scale {
+		digits = strings.Repeat("0", scale-len(digits)+1) + digits
+	}
+
+	sign := ""
+	if units.Sign() < 0 {
+		sign = "-"
+	}
+	if scale == 0 {
+		return sign + digits
+	}
+
+	return sign + digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+}
+
+/**
+ * Reports whether a string consists of ASCII digits only
+ *
+ * @param s The string to check
+ *
+ * @return True if every character is a digit
+ */
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
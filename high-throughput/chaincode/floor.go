@@ -0,0 +1,222 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Floors. Nothing is read when a delta is recorded, so a "-" update can take a variable below zero. A variable
+ * created with a floor instead has its deltas applied in transaction timestamp order when it is aggregated, and
+ * any delta which would lower the value below the floor is left out of the value and flagged as a violation.
+ * Pruning and checkpointing record the violations they find as those delta rows are not read again. Until a
+ * bucket is checkpointed, a delta with an earlier timestamp can still change which of its deltas are flagged, once
+ * it is checkpointed its violations are final.
+ *
+ * Deltas which must never be rejected after the fact, e.g. payments, should be debited from a reservation
+ * instead, see reservation.go.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key under which violations are recorded
+const violationIndex = "violation~varName~txID"
+
+// violation is a delta left out of a variable's value because it would have lowered it below the floor
+type violation struct {
+	Op    string `json:"op"`
+	Value string `json:"value"`
+	TxID  string `json:"txid"`
+	// Transaction timestamp in nanoseconds
+	Time int64 `json:"time"`
+	// Whether the violation was recorded by a prune or checkpoint rather than found among the pending deltas
+	Recorded bool `json:"recorded"`
+}
+
+/**
+ * Parses a single value according to the variable's configuration
+ *
+ * @param config The configuration of the variable
+ * @param value The value to parse
+ *
+ * @return An aggregate holding the value
+ */
+func valueOf(config varConfig, value string) (*aggregate, error) {
+	a := newAggregate(config)
+	applyErr := a.apply(delta{op: "+", value: value})
+	if applyErr != nil {
+		return nil, applyErr
+	}
+
+	return a, nil
+}
+
+/**
+ * Compares the values of two aggregates of the same variable
+ *
+ * @param b The aggregate to compare with
+ *
+ * @return -1, 0 or 1 if the aggregate is lower than, equal to or higher than b
+ */
+func (a *aggregate) cmp(b *aggregate) int {
+	if a.config.decimal() {
+		return a.units.Cmp(b.units)
+	}
+
+	if a.value < b.value {
+		return -1
+	}
+	if a.value > b.value {
+		return 1
+	}
+	return 0
+}
+
+/**
+ * Copies the aggregate so that it can be restored if a delta is rejected
+ *
+ * @return The copy
+ */
+func (a *aggregate) clone() *aggregate {
+	c := *a
+	c.units = new(big.Int).Set(a.units)
+
+	return &c
+}
+
+/**
+ * Folds a delta into the aggregate unless it would lower the value below the floor, in which case the delta
+ * is recorded as a violation instead
+ *
+ * @param d The delta to apply
+ * @param floor The floor of the variable
+ *
+ * @return An error if the delta could not be applied
+ */
+func (a *aggregate) applyAboveFloor(d delta, floor *aggregate) error {
+	before := a.clone()
+	applyErr := a.apply(d)
+	if applyErr != nil {
+		return applyErr
+	}
+
+	if a.cmp(before) < 0 && a.cmp(floor) < 0 {
+		violations := append(a.violations, d)
+		*a = *before
+		a.violations = violations
+	}
+
+	return nil
+}
+
+/**
+ * Sorts deltas into the order their transactions were submitted, ties are broken by txID
+ *
+ * @param deltas The deltas to sort
+ */
+func sortDeltas(deltas []delta) {
+	sort.Slice(deltas, func(i, j int) bool {
+		if deltas[i].time != deltas[j].time {
+			return deltas[i].time < deltas[j].time
+		}
+		return deltas[i].txID < deltas[j].txID
+	})
+}
+
+/**
+ * Records the violations found while pruning or checkpointing a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param violations The deltas left out of the value
+ *
+ * @return An error if a violation could not be recorded
+ */
+func recordViolations(APIstub shim.ChaincodeStubInterface, name string, violations []delta) error {
+	for _, d := range violations {
+		violationKey, compositeErr := APIstub.CreateCompositeKey(violationIndex, []string{name, d.txID})
+		if compositeErr != nil {
+			return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+		}
+
+		violationBytes, marshalErr := json.Marshal(violation{Op: d.op, Value: d.value, TxID: d.txID, Time: d.time, Recorded: true})
+		if marshalErr != nil {
+			return marshalErr
+		}
+
+		violationPutErr := APIstub.PutState(violationKey, violationBytes)
+		if violationPutErr != nil {
+			return fmt.Errorf("Could not record a violation for %s: %s", name, violationPutErr.Error())
+		}
+	}
+
+	return nil
+}
+
+/**
+ * Lists the deltas which were left out of a variable's value because they would have lowered it below its
+ * floor, both those recorded by earlier prunes and checkpoints and those among the pending deltas. The args array
+ * contains the following argument:
+ *	- args[0] -> The name of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the violations invocation
+ *
+ * @return A response structure with a JSON array of violations, oldest first
+ */
+func (s *SmartContract) violations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	results := []violation{}
+
+	// Violations recorded by earlier prunes and checkpoints
+	violationResultsIterator, violationErr := APIstub.GetStateByPartialCompositeKey(violationIndex, []string{name})
+	if violationErr != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve violations for %s: %s", name, violationErr.Error()))
+	}
+	defer violationResultsIterator.Close()
+	for violationResultsIterator.HasNext() {
+		responseRange, nextErr := violationResultsIterator.Next()
+		if nextErr != nil {
+			return shim.Error(nextErr.Error())
+		}
+
+		v := violation{}
+		unmarshalErr := json.Unmarshal(responseRange.Value, &v)
+		if unmarshalErr != nil {
+			return shim.Error(fmt.Sprintf("Could not read a violation of %s: %s", name, unmarshalErr.Error()))
+		}
+		results = append(results, v)
+	}
+
+	// Violations among the pending deltas
+	val, err := computeAggregate(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, d := range val.violations {
+		results = append(results, violation{Op: d.op, Value: d.value, TxID: d.txID, Time: d.time})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time < results[j].Time
+	})
+
+	resultsBytes, marshalErr := json.Marshal(results)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+
+	return shim.Success(resultsBytes)
+}
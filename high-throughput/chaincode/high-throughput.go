@@ -27,6 +27,7 @@ package main
  */
 import (
 	"fmt"
+	"math"
 	"strconv"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
@@ -50,26 +51,63 @@ func (s *SmartContract) Init(APIstub shim.ChaincodeStubInterface) sc.Response {
 
 // Invoke routes invocations to the appropriate function in chaincode
 // Current supported invocations are:
+//	- create, declares a variable before its first update, optionally with exact decimal arithmetic
 //	- update, adds a delta to an aggregate variable in the ledger, all variables are assumed to start at 0
 //	- get, retrieves the aggregate value of a variable in the ledger
-//	- pruneFast, deletes all rows associated with the variable and replaces them with a single row containing the aggregate value
-//	- pruneSafe, same as pruneFast except it pre-computed the value and backs it up before performing any destructive operations
+//	- getat, retrieves the aggregate value of a variable as it was at a point in time
+//	- updatebatch and getmany, record deltas for and retrieve the values of many variables in one transaction
+//	- pruneFast, checkpoints the closed buckets of a variable and deletes all rows covered by its checkpoints
+//	- pruneSafe, same as pruneFast except it backs up the checkpointed value before performing any destructive operations
 //	- delete, removes all rows associated with the variable
+//	- prunebatch, deletes a batch of the rows covered by the latest checkpoint, carrying on from the previous batch
+//	- checkpoint, folds the closed buckets of a variable into checkpoints so that get only reads newer deltas
+//	- violations, lists the deltas left out of a variable's value for taking it below its floor
+//	- reserve, debit and release, take an amount out of a variable with a floor and spend it without overdrafts
+//	- reservations, lists the open reservations of a variable
+//	- list and stats, list the variables in the ledger and describe the rows of a variable
 func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response {
 	// Retrieve the requested Smart Contract function and arguments
 	function, args := APIstub.GetFunctionAndParameters()
 
 	// Route to the appropriate handler function to interact with the ledger appropriately
-	if function == "update" {
+	if function == "create" {
+		return s.create(APIstub, args)
+	} else if function == "update" {
 		return s.update(APIstub, args)
 	} else if function == "get" {
 		return s.get(APIstub, args)
+	} else if function == "getat" {
+		return s.getAt(APIstub, args)
+	} else if function == "updatebatch" {
+		return s.updateBatch(APIstub, args)
+	} else if function == "getmany" {
+		return s.getMany(APIstub, args)
 	} else if function == "prunefast" {
 		return s.pruneFast(APIstub, args)
 	} else if function == "prunesafe" {
 		return s.pruneSafe(APIstub, args)
 	} else if function == "delete" {
 		return s.delete(APIstub, args)
+	} else if function == "prunebatch" {
+		return s.pruneBatch(APIstub, args)
+	} else if function == "checkpoint" {
+		return s.checkpoint(APIstub, args)
+	} else if function == "violations" {
+		return s.violations(APIstub, args)
+	} else if function == "reserve" {
+		return s.reserve(APIstub, args)
+	} else if function == "debit" {
+		return s.debit(APIstub, args)
+	} else if function == "release" {
+		return s.release(APIstub, args)
+	} else if function == "reservations" {
+		return s.reservations(APIstub, args)
+	} else if function == "list" {
+		return s.list(APIstub, args)
+	} else if function == "stats" {
+		return s.stats(APIstub, args)
+	} else if function == "register" {
+		return s.register(APIstub, args)
 	} else if function == "putstandard" {
 		return s.putStandard(APIstub, args)
 	} else if function == "getstandard" {
@@ -84,8 +122,12 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
  * this variable is being added to the ledger, then its initial value is assumed to be 0. The arguments
  * to give in the args array are as follows:
  *	- args[0] -> name of the variable
- *	- args[1] -> new delta (float)
- *	- args[2] -> operation (currently supported are addition "+" and subtraction "-")
+ *	- args[1] -> new delta (float, or a decimal with at most scale decimal places for decimal variables)
+ *	- args[2] -> operation (currently supported are addition "+", subtraction "-", multiplication "*",
+ *	             division "/", "max", "min" and "set", see aggregate.go for how each is aggregated)
+ *
+ * The delta row is filed under the bucket of the transaction timestamp and stores the timestamp so that "set"
+ * deltas can be ordered. Updates into a bucket which has already been checkpointed are rejected.
  *
  * @param APIstub The chaincode shim
  * @param args The arguments array for the update invocation
@@ -101,39 +143,95 @@ func (s *SmartContract) update(APIstub shim.ChaincodeStubInterface, args []strin
 	// Extract the args
 	name := args[0]
 	op := args[2]
-	_, err := strconv.ParseFloat(args[1], 64)
-	if err != nil {
-		return shim.Error("Provided value was not a number")
+
+	recordErr := recordDelta(APIstub, name, op, args[1], APIstub.GetTxID())
+	if recordErr != nil {
+		return shim.Error(recordErr.Error())
+	}
+
+	if opFamily(op) != familyAdditive {
+		return shim.Success([]byte(fmt.Sprintf("Successfully recorded %s %s for %s", op, args[1], name)))
 	}
+	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, args[1], name)))
+}
 
+/**
+ * Validates a delta against its variable and writes its row to the ledger, marking its bucket as pending and
+ * registering the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param op The operator of the delta
+ * @param value The delta value
+ * @param txid The ID the delta is recorded under, unique among the deltas of the variable
+ *
+ * @return An error if the delta is not valid or could not be recorded
+ */
+func recordDelta(APIstub shim.ChaincodeStubInterface, name string, op string, value string, txid string) error {
 	// Make sure a valid operator is provided
-	if op != "+" && op != "-" {
-		return shim.Error(fmt.Sprintf("Operator %s is unrecognized", op))
+	if opFamily(op) == "" {
+		return fmt.Errorf("Operator %s is unrecognized", op)
+	}
+
+	// Make sure the value suits the variable
+	config, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return configErr
+	}
+	validateErr := config.validate(op, value)
+	if validateErr != nil {
+		return validateErr
 	}
 
 	// Retrieve info needed for the update procedure
-	txid := APIstub.GetTxID()
-	compositeIndexName := "varName~op~value~txID"
+	txTime, timeErr := txTimeOf(APIstub)
+	if timeErr != nil {
+		return timeErr
+	}
+	bucket := bucketOf(txTime)
+
+	// Make sure the bucket has not been folded into a checkpoint already
+	bucketErr := checkBucketOpen(APIstub, name, bucket)
+	if bucketErr != nil {
+		return bucketErr
+	}
 
 	// Create the composite key that will allow us to query for all deltas on a particular variable
-	compositeKey, compositeErr := APIstub.CreateCompositeKey(compositeIndexName, []string{name, op, args[1], txid})
+	compositeKey, compositeErr := APIstub.CreateCompositeKey(deltaBucketIndex, []string{name, bucket, op, value, txid})
 	if compositeErr != nil {
-		return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, compositeErr.Error()))
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
 	}
 
-	// Save the composite key index
-	compositePutErr := APIstub.PutState(compositeKey, []byte{0x00})
+	// Save the composite key index, along with the transaction timestamp
+	compositePutErr := APIstub.PutState(compositeKey, []byte(strconv.FormatInt(txTime, 10)))
 	if compositePutErr != nil {
-		return shim.Error(fmt.Sprintf("Could not put operation for %s in the ledger: %s", name, compositePutErr.Error()))
+		return fmt.Errorf("Could not put operation for %s in the ledger: %s", name, compositePutErr.Error())
 	}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully added %s%s to %s", op, args[1], name)))
+	// Mark the bucket as pending, concurrent updates write the same value without reading it
+	pendingKey, compositeErr := APIstub.CreateCompositeKey(pendingBucketIndex, []string{name, bucket})
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+	pendingPutErr := APIstub.PutState(pendingKey, []byte{0x00})
+	if pendingPutErr != nil {
+		return fmt.Errorf("Could not mark bucket %s of %s as pending: %s", bucket, name, pendingPutErr.Error())
+	}
+
+	// Register the variable and its update without reading anything, see registry.go
+	if !declared {
+		registerErr := putRegistration(APIstub, name, registration{})
+		if registerErr != nil {
+			return registerErr
+		}
+	}
+	return putMarker(APIstub, name, bucket, txTime)
 }
 
 /**
- * Retrieves the aggregate value of a variable in the ledger. Gets all delta rows for the variable
- * and computes the final value from all deltas. The args array for the invocation must contain the
- * following argument:
+ * Retrieves the aggregate value of a variable in the ledger. Starts from the latest checkpoint of the
+ * variable and folds in the delta rows of the buckets which have not been checkpointed yet, see
+ * checkpoint.go. The args array for the invocation must contain the following argument:
  *	- args[0] -> The name of the variable to get the value of
  *
  * @param APIstub The chaincode shim
@@ -148,63 +246,21 @@ func (s *SmartContract) get(APIstub shim.ChaincodeStubInterface, args []string)
 	}
 
 	name := args[0]
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
-	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
-		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
-	}
-
-	// Iterate through result set and compute final value
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the composite key into its component parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the delta value and operation
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value string and perform the operation
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	finalVal, err := computeAggregate(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	return shim.Success([]byte(strconv.FormatFloat(finalVal, 'f', -1, 64)))
+	return shim.Success([]byte(finalVal.String()))
 }
 
 /**
- * Prunes a variable by deleting all of its delta rows while computing the final value. Once all rows
- * have been processed and deleted, a single new row is added which defines a delta containing the final
- * computed value of the variable. This function is NOT safe as any failures or errors during pruning
- * will result in an undefined final value for the variable and loss of data. Use pruneSafe if data
- * integrity is important. The args array contains the following argument:
+ * Prunes a variable by checkpointing its closed buckets and deleting every delta row covered by its checkpoints.
+ * The bucket still receiving updates, and any bucket within the checkpoint grace period, is neither read nor
+ * deleted, so updates submitted while the variable is being pruned do not invalidate the prune. As the value
+ * is held by the latest checkpoint rather than a new delta row, no value is lost if the prune fails part way.
+ * All covered rows are deleted in a single transaction, use prunebatch for variables with too many rows for
+ * that. The args array contains the following argument:
  *	- args[0] -> The name of the variable to prune
  *
  * @param APIstub The chaincode shim
@@ -221,75 +277,32 @@ func (s *SmartContract) pruneFast(APIstub shim.ChaincodeStubInterface, args []st
 	// Retrieve the name of the variable to prune
 	name := args[0]
 
-	// Get all delta rows for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
+	// Fold the closed buckets into checkpoints
+	latest, checkpointErr := checkpointForPrune(APIstub, name)
+	if checkpointErr != nil {
+		return shim.Error(checkpointErr.Error())
 	}
-	defer deltaResultsIterator.Close()
-
-	// Check the variable existed
-	if !deltaResultsIterator.HasNext() {
-		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	if latest == nil {
+		return shim.Success([]byte(fmt.Sprintf("Variable %s has no closed buckets to prune", name)))
 	}
 
-	// Iterate through result set computing final value while iterating and deleting each key
-	var finalVal float64
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		// Get the next row
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(nextErr.Error())
-		}
-
-		// Split the key into its composite parts
-		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
-		if splitKeyErr != nil {
-			return shim.Error(splitKeyErr.Error())
-		}
-
-		// Retrieve the operation and value
-		operation := keyParts[1]
-		valueStr := keyParts[2]
-
-		// Convert the value to a float
-		value, convErr := strconv.ParseFloat(valueStr, 64)
-		if convErr != nil {
-			return shim.Error(convErr.Error())
-		}
-
-		// Delete the row from the ledger
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
-
-		// Add the value of the deleted row to the final aggregate
-		switch operation {
-		case "+":
-			finalVal += value
-		case "-":
-			finalVal -= value
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
+	// Delete each delta row covered by the checkpoints
+	pruned, _, pruneErr := pruneCheckpointed(APIstub, name, latest, math.MaxInt32)
+	if pruneErr != nil {
+		return shim.Error(pruneErr.Error())
 	}
-
-	// Update the ledger with the final value and return
-	updateResp := s.update(APIstub, []string{name, strconv.FormatFloat(finalVal, 'f', -1, 64), "+"})
-	if updateResp.Status == OK {
-		return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", args[0], finalVal, i)))
+	if pruned == 0 {
+		return shim.Success([]byte(fmt.Sprintf("Variable %s has no rows to prune", name)))
 	}
 
-	return shim.Error(fmt.Sprintf("Failed to prune variable: all rows deleted but could not update value to %f, variable no longer exists in ledger", finalVal))
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s up to bucket %s, value at the end of it is %s, %d rows pruned", name, latest.Bucket, latest.Value, pruned)))
 }
 
 /**
  * This function performs the same function as pruneFast except it provides data backups in case the
- * prune fails. The final aggregate value is computed before any deletion occurs and is backed up
- * to a new row. This back-up row is deleted only after the new aggregate delta has been successfully
- * written to the ledger. The args array contains the following argument:
+ * prune fails. The value at the end of the last closed bucket is computed before any deletion occurs and is
+ * backed up to a new row. This back-up row is deleted only after the delta rows have been successfully
+ * deleted. The args array contains the following argument:
  *	args[0] -> The name of the variable to prune
  *
  * @param APIstub The chaincode shim
@@ -306,49 +319,25 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 	// Get the var name
 	name := args[0]
 
-	// Get the var's value and process it
-	getResp := s.get(APIstub, args)
-	if getResp.Status == ERROR {
-		return shim.Error(fmt.Sprintf("Could not retrieve the value of %s before pruning, pruning aborted: %s", name, getResp.Message))
+	// Get the var's value at the end of the last closed bucket
+	latest, checkpointErr := checkpointForPrune(APIstub, name)
+	if checkpointErr != nil {
+		return shim.Error(fmt.Sprintf("Could not checkpoint %s before pruning, pruning aborted: %s", name, checkpointErr.Error()))
 	}
-
-	valueStr := string(getResp.Payload)
-	val, convErr := strconv.ParseFloat(valueStr, 64)
-	if convErr != nil {
-		return shim.Error(fmt.Sprintf("Could not convert the value of %s to a number before pruning, pruning aborted: %s", name, convErr.Error()))
+	if latest == nil {
+		return shim.Success([]byte(fmt.Sprintf("Variable %s has no closed buckets to prune", name)))
 	}
 
 	// Store the var's value temporarily
-	backupPutErr := APIstub.PutState(fmt.Sprintf("%s_PRUNE_BACKUP", name), []byte(valueStr))
+	backupPutErr := APIstub.PutState(fmt.Sprintf("%s_PRUNE_BACKUP", name), []byte(latest.Value))
 	if backupPutErr != nil {
 		return shim.Error(fmt.Sprintf("Could not backup the value of %s before pruning, pruning aborted: %s", name, backupPutErr.Error()))
 	}
 
-	// Get all deltas for the variable
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve value for %s: %s", name, deltaErr.Error()))
-	}
-	defer deltaResultsIterator.Close()
-
-	// Delete each row
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next row for pruning: %s", nextErr.Error()))
-		}
-
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
-		}
-	}
-
-	// Insert new row for the final value
-	updateResp := s.update(APIstub, []string{name, valueStr, "+"})
-	if updateResp.Status == ERROR {
-		return shim.Error(fmt.Sprintf("Could not insert the final value of the variable after pruning, variable backup is stored in %s_PRUNE_BACKUP: %s", name, updateResp.Message))
+	// Delete each row covered by the checkpoints
+	i, _, pruneErr := pruneCheckpointed(APIstub, name, latest, math.MaxInt32)
+	if pruneErr != nil {
+		return shim.Error(fmt.Sprintf("Could not delete the rows of %s, variable backup is stored in %s_PRUNE_BACKUP: %s", name, name, pruneErr.Error()))
 	}
 
 	// Delete the backup value
@@ -356,13 +345,17 @@ func (s *SmartContract) pruneSafe(APIstub shim.ChaincodeStubInterface, args []st
 	if delErr != nil {
 		return shim.Error(fmt.Sprintf("Could not delete backup value %s_PRUNE_BACKUP, this does not affect the ledger but should be removed manually", name))
 	}
+	if i == 0 {
+		return shim.Success([]byte(fmt.Sprintf("Variable %s has no rows to prune", name)))
+	}
 
-	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s, final value is %f, %d rows pruned", name, val, i)))
+	return shim.Success([]byte(fmt.Sprintf("Successfully pruned variable %s up to bucket %s, value at the end of it is %s, %d rows pruned", name, latest.Bucket, latest.Value, i)))
 }
 
 /**
- * Deletes all rows associated with an aggregate variable from the ledger. The args array
- * contains the following argument:
+ * Deletes all rows associated with an aggregate variable from the ledger, including its configuration if it
+ * was created with create, its recorded violations, its open reservations and its registry entries. The args
+ * array contains the following argument:
  *	- args[0] -> The name of the variable to delete
  *
  * @param APIstub The chaincode shim
@@ -379,29 +372,62 @@ func (s *SmartContract) delete(APIstub shim.ChaincodeStubInterface, args []strin
 	// Retrieve the variable name
 	name := args[0]
 
-	// Delete all delta rows
-	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey("varName~op~value~txID", []string{name})
-	if deltaErr != nil {
-		return shim.Error(fmt.Sprintf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error()))
+	// Check whether the variable was created with a configuration
+	_, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
 	}
-	defer deltaResultsIterator.Close()
 
 	// Ensure the variable exists
-	if !deltaResultsIterator.HasNext() {
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return shim.Error(latestErr.Error())
+	}
+	updated, deltaErr := hasDeltas(APIstub, name)
+	if deltaErr != nil {
+		return shim.Error(deltaErr.Error())
+	}
+	if !declared && latest == nil && !updated {
 		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
 	}
 
-	// Iterate through result set and delete all indices
-	var i int
-	for i = 0; deltaResultsIterator.HasNext(); i++ {
-		responseRange, nextErr := deltaResultsIterator.Next()
-		if nextErr != nil {
-			return shim.Error(fmt.Sprintf("Could not retrieve next delta row: %s", nextErr.Error()))
+	// Delete all delta rows and checkpoints
+	i, deleteErr := deleteRows(APIstub, name)
+	if deleteErr != nil {
+		return shim.Error(deleteErr.Error())
+	}
+
+	// Delete the recorded violations, open reservations and registry entries
+	for _, index := range []string{violationIndex, reservationIndex, variableIndex, registryIndex} {
+		indexResultsIterator, indexErr := APIstub.GetStateByPartialCompositeKey(index, []string{name})
+		if indexErr != nil {
+			return shim.Error(fmt.Sprintf("Could not retrieve rows for %s: %s", name, indexErr.Error()))
+		}
+		for indexResultsIterator.HasNext() {
+			responseRange, nextErr := indexResultsIterator.Next()
+			if nextErr != nil {
+				indexResultsIterator.Close()
+				return shim.Error(fmt.Sprintf("Could not retrieve next row: %s", nextErr.Error()))
+			}
+
+			rowDelErr := APIstub.DelState(responseRange.Key)
+			if rowDelErr != nil {
+				indexResultsIterator.Close()
+				return shim.Error(fmt.Sprintf("Could not delete row: %s", rowDelErr.Error()))
+			}
 		}
+		indexResultsIterator.Close()
+	}
 
-		deltaRowDelErr := APIstub.DelState(responseRange.Key)
-		if deltaRowDelErr != nil {
-			return shim.Error(fmt.Sprintf("Could not delete delta row: %s", deltaRowDelErr.Error()))
+	// Delete the configuration
+	if declared {
+		configKey, compositeErr := APIstub.CreateCompositeKey(configIndex, []string{name})
+		if compositeErr != nil {
+			return shim.Error(fmt.Sprintf("Could not create a composite key for %s: %s", name, compositeErr.Error()))
+		}
+		configDelErr := APIstub.DelState(configKey)
+		if configDelErr != nil {
+			return shim.Error(fmt.Sprintf("Could not delete the configuration of %s: %s", name, configDelErr.Error()))
 		}
 	}
 
@@ -0,0 +1,335 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Pruning. Only rows covered by a checkpoint are pruned: get no longer reads them, so they can be deleted
+ * without changing the value of the variable, and the bucket still receiving updates is left alone, so a prune
+ * neither reads nor deletes the rows concurrent updates are adding and does not fail validation because of them.
+ * pruneFast and pruneSafe delete every covered row in a single transaction, which fails outright once a
+ * variable has accumulated more rows than a transaction can hold. prunebatch instead deletes them a batch at a
+ * time: the checkpoint is the partial aggregate of everything pruned so far, and a cursor row records the
+ * bucket pruning has reached so that the next batch carries on from there. A failed batch leaves the variable
+ * exactly as it was.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key under which the prune cursor of a variable is stored
+const pruneCursorIndex = "pruneCursor~varName"
+
+// Number of rows pruned per batch unless another limit is given
+const defaultPruneBatch = 1000
+
+// pruneCursor records how far batch pruning of a variable has progressed
+type pruneCursor struct {
+	// Bucket being pruned, empty while rows from before the first checkpointed bucket remain
+	Bucket string `json:"bucket"`
+	// Number of rows pruned so far
+	Pruned int `json:"pruned"`
+	// Whether some of the rows of the bucket have already been pruned
+	Partial bool `json:"partial,omitempty"`
+}
+
+/**
+ * Retrieves the prune cursor of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The composite key of the cursor, the cursor, empty if the variable has not been pruned, or an error
+ */
+func getPruneCursor(APIstub shim.ChaincodeStubInterface, name string) (string, pruneCursor, error) {
+	cursor := pruneCursor{}
+
+	cursorKey, compositeErr := APIstub.CreateCompositeKey(pruneCursorIndex, []string{name})
+	if compositeErr != nil {
+		return "", cursor, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+	cursorBytes, cursorErr := APIstub.GetState(cursorKey)
+	if cursorErr != nil {
+		return "", cursor, fmt.Errorf("Could not retrieve the prune cursor of %s: %s", name, cursorErr.Error())
+	}
+	if cursorBytes != nil {
+		unmarshalErr := json.Unmarshal(cursorBytes, &cursor)
+		if unmarshalErr != nil {
+			return "", cursor, fmt.Errorf("Could not read the prune cursor of %s: %s", name, unmarshalErr.Error())
+		}
+	}
+
+	return cursorKey, cursor, nil
+}
+
+/**
+ * Deletes up to limit rows under a partial key
+ *
+ * @param APIstub The chaincode shim
+ * @param index The index of the rows
+ * @param keys The partial key of the rows
+ * @param limit The largest number of rows to delete
+ *
+ * @return The number of rows deleted and whether no rows remain
+ */
+func pruneRows(APIstub shim.ChaincodeStubInterface, index string, keys []string, limit int) (int, bool, error) {
+	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(index, keys)
+	if deltaErr != nil {
+		return 0, false, fmt.Errorf("Could not retrieve delta rows for %s: %s", keys[0], deltaErr.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	var deleted int
+	for deltaResultsIterator.HasNext() {
+		if deleted == limit {
+			return deleted, false, nil
+		}
+
+		responseRange, nextErr := deltaResultsIterator.Next()
+		if nextErr != nil {
+			return deleted, false, fmt.Errorf("Could not retrieve next row for pruning: %s", nextErr.Error())
+		}
+
+		deltaRowDelErr := APIstub.DelState(responseRange.Key)
+		if deltaRowDelErr != nil {
+			return deleted, false, fmt.Errorf("Could not delete delta row: %s", deltaRowDelErr.Error())
+		}
+		deleted++
+	}
+
+	return deleted, true, nil
+}
+
+/**
+ * Deletes up to limit bucketed rows of a variable in buckets before a bucket. The rows are read in bucket order
+ * and reading stops at the first row not before that bucket. Rows of a bucket which is still pending are left
+ * alone, they were recorded after the bucket was passed and have not been folded into a checkpoint yet.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param before The bucket to stop at
+ * @param limit The largest number of rows to delete
+ *
+ * @return The number of rows deleted, the bucket of the last row deleted and whether no such rows remain
+ */
+func pruneRowsBefore(APIstub shim.ChaincodeStubInterface, name string, before string, limit int) (int, string, bool, error) {
+	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(deltaBucketIndex, []string{name})
+	if deltaErr != nil {
+		return 0, "", false, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	var deleted int
+	var last, bucket string
+	var pending bool
+	for deltaResultsIterator.HasNext() {
+		if deleted == limit {
+			return deleted, last, false, nil
+		}
+
+		responseRange, nextErr := deltaResultsIterator.Next()
+		if nextErr != nil {
+			return deleted, last, false, fmt.Errorf("Could not retrieve next row for pruning: %s", nextErr.Error())
+		}
+		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+		if splitKeyErr != nil {
+			return deleted, last, false, splitKeyErr
+		}
+		if keyParts[1] >= before {
+			break
+		}
+
+		if keyParts[1] != bucket {
+			bucket = keyParts[1]
+			pendingKey, compositeErr := APIstub.CreateCompositeKey(pendingBucketIndex, []string{name, bucket})
+			if compositeErr != nil {
+				return deleted, last, false, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+			}
+			pendingBytes, pendingErr := APIstub.GetState(pendingKey)
+			if pendingErr != nil {
+				return deleted, last, false, fmt.Errorf("Could not retrieve pending bucket %s of %s: %s", bucket, name, pendingErr.Error())
+			}
+			pending = pendingBytes != nil
+		}
+		if pending {
+			continue
+		}
+
+		deltaRowDelErr := APIstub.DelState(responseRange.Key)
+		if deltaRowDelErr != nil {
+			return deleted, last, false, fmt.Errorf("Could not delete delta row: %s", deltaRowDelErr.Error())
+		}
+		deleted++
+		last = bucket
+	}
+
+	return deleted, last, true, nil
+}
+
+/**
+ * Prunes up to limit rows of a variable which are covered by its latest checkpoint, carrying on from and
+ * advancing the variable's prune cursor. The bucketed rows are deleted in key order, so buckets without deltas
+ * cost nothing, and the rows of the latest checkpointed bucket on their own, so reading never goes past them
+ * into the buckets still receiving updates.
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param latest The latest checkpoint of the variable
+ * @param limit The largest number of rows to delete
+ *
+ * @return The number of rows deleted and the updated cursor
+ */
+func pruneCheckpointed(APIstub shim.ChaincodeStubInterface, name string, latest *checkpoint, limit int) (int, pruneCursor, error) {
+	// Carry on from the previous batch
+	cursorKey, cursor, cursorErr := getPruneCursor(APIstub, name)
+	if cursorErr != nil {
+		return 0, cursor, cursorErr
+	}
+
+	remaining := limit
+
+	// Rows recorded before buckets were introduced come first
+	if cursor.Bucket == "" {
+		deleted, exhausted, pruneErr := pruneRows(APIstub, deltaIndex, []string{name}, remaining)
+		if pruneErr != nil {
+			return 0, cursor, pruneErr
+		}
+		remaining -= deleted
+
+		if exhausted {
+			cursor.Bucket = latest.First
+		}
+	}
+
+	// Then the checkpointed buckets in order
+	if cursor.Bucket != "" && cursor.Bucket <= latest.Bucket && remaining > 0 {
+		deleted, last, exhausted, pruneErr := pruneRowsBefore(APIstub, name, latest.Bucket, remaining)
+		if pruneErr != nil {
+			return 0, cursor, pruneErr
+		}
+		remaining -= deleted
+
+		if exhausted {
+			deleted, exhausted, pruneErr = pruneRows(APIstub, deltaBucketIndex, []string{name, latest.Bucket}, remaining)
+			if pruneErr != nil {
+				return 0, cursor, pruneErr
+			}
+			remaining -= deleted
+			if deleted > 0 {
+				last = latest.Bucket
+			}
+		}
+
+		if exhausted {
+			var nextErr error
+			cursor.Partial = false
+			cursor.Bucket, nextErr = nextBucket(latest.Bucket)
+			if nextErr != nil {
+				return 0, cursor, nextErr
+			}
+		} else if last != "" {
+			cursor.Bucket = last
+			cursor.Partial = true
+		}
+	}
+
+	pruned := limit - remaining
+	cursor.Pruned += pruned
+	cursorBytes, marshalErr := json.Marshal(cursor)
+	if marshalErr != nil {
+		return 0, cursor, marshalErr
+	}
+	cursorPutErr := APIstub.PutState(cursorKey, cursorBytes)
+	if cursorPutErr != nil {
+		return 0, cursor, fmt.Errorf("Could not put the prune cursor of %s in the ledger: %s", name, cursorPutErr.Error())
+	}
+
+	return pruned, cursor, nil
+}
+
+/**
+ * Checkpoints the closed buckets of a variable ahead of pruning it
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The latest checkpoint, nil if the variable has no closed buckets, or an error if it does not exist
+ */
+func checkpointForPrune(APIstub shim.ChaincodeStubInterface, name string) (*checkpoint, error) {
+	latest, _, checkpointErr := checkpointBuckets(APIstub, name)
+	if checkpointErr != nil || latest != nil {
+		return latest, checkpointErr
+	}
+
+	// Ensure the variable exists
+	_, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return nil, configErr
+	}
+	updated, deltaErr := hasDeltas(APIstub, name)
+	if deltaErr != nil {
+		return nil, deltaErr
+	}
+	if !declared && !updated {
+		return nil, fmt.Errorf("No variable by the name %s exists", name)
+	}
+
+	return nil, nil
+}
+
+/**
+ * Prunes a batch of the rows of a variable which are covered by its latest checkpoint, starting from where the
+ * previous batch stopped. The value of the variable is unaffected, run checkpoint first to make more rows
+ * prunable. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable to prune
+ *	- args[1] -> Optional, the largest number of rows to prune in this transaction, 1000 by default
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the pruneBatch invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) pruneBatch(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 && len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 1 or 2")
+	}
+
+	name := args[0]
+	limit := defaultPruneBatch
+	if len(args) == 2 && args[1] != "" {
+		var convErr error
+		limit, convErr = strconv.Atoi(args[1])
+		if convErr != nil || limit < 1 {
+			return shim.Error("Batch size must be a whole number above 0")
+		}
+	}
+
+	// Only rows covered by a checkpoint can be pruned
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return shim.Error(latestErr.Error())
+	}
+	if latest == nil {
+		return shim.Error(fmt.Sprintf("Variable %s has not been checkpointed, run checkpoint before pruning", name))
+	}
+
+	// Carry on from the previous batch
+	pruned, cursor, pruneErr := pruneCheckpointed(APIstub, name, latest, limit)
+	if pruneErr != nil {
+		return shim.Error(pruneErr.Error())
+	}
+
+	if cursor.Bucket != "" && cursor.Bucket > latest.Bucket {
+		return shim.Success([]byte(fmt.Sprintf("Pruned %d rows of %s, %d rows pruned in total, all rows up to bucket %s have been pruned", pruned, name, cursor.Pruned, latest.Bucket)))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Pruned %d rows of %s, %d rows pruned in total, run prunebatch again to continue", pruned, name, cursor.Pruned)))
+}
@@ -0,0 +1,510 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Variable registry. Variables are created implicitly by their first update, so nothing records which exist.
+ * Every variable has a registry row, which list reads. create writes it along with the time the variable was
+ * created. Updates of a variable which was not declared write it blindly instead, always with the same value,
+ * so concurrent updates do not conflict over it. The creation time of such a variable is that of its first
+ * update: its first checkpoint records it, and until then it is read from the deltas of the oldest pending
+ * bucket. Variables only holding rows recorded before buckets were introduced have no known creation time.
+ *
+ * The last update of a variable is not held by the registry row, as that would have to be read and rewritten
+ * by every update and become the hot key the delta rows avoid. Instead every update blindly writes a marker row
+ * for its variable and bucket, holding the update's transaction, and the marker is left holding the last update
+ * committed in the bucket. The markers are only read by stats. They are kept when a variable is pruned and
+ * removed along with the registry row when it is deleted. Undeclared variables created before the registry was
+ * introduced are registered by their next update, declared ones and those no longer updated by register.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite keys under which the registry rows and markers are stored
+const (
+	variableIndex = "registry~varName"
+	registryIndex = "registry~varName~bucket"
+)
+
+// registration is the registry row of a variable
+type registration struct {
+	// Whether the variable was declared with create
+	Declared bool `json:"declared"`
+	// Transaction and timestamp in nanoseconds of the create invocation, empty for other variables
+	TxID string `json:"txid,omitempty"`
+	Time int64  `json:"time,omitempty"`
+}
+
+// marker is the last update of a variable within a bucket
+type marker struct {
+	TxID string `json:"txid"`
+	// Transaction timestamp in nanoseconds
+	Time int64 `json:"time"`
+}
+
+// varInfo describes a variable in the registry
+type varInfo struct {
+	Name string `json:"name"`
+	// Whether the variable was declared with create
+	Declared bool `json:"declared"`
+	// Transaction and timestamp the variable was created by, empty if unknown
+	CreatedTxID string `json:"created_txid,omitempty"`
+	Created     int64  `json:"created,omitempty"`
+}
+
+// varStats are the statistics of a single variable
+type varStats struct {
+	varInfo
+	Mode string `json:"mode"`
+	// Bucket of the first update recorded by a marker, empty if the variable has not been updated
+	FirstBucket string `json:"first_bucket,omitempty"`
+	LastTxID    string `json:"last_txid,omitempty"`
+	LastTime    int64  `json:"last_time,omitempty"`
+	// Number of delta rows currently in the ledger
+	DeltaRows int `json:"delta_rows"`
+	// Bucket the variable has been checkpointed up to, empty if it has not been checkpointed
+	CheckpointedTo string `json:"checkpointed_to,omitempty"`
+	// Number of delta rows deleted by prunes since the variable was first checkpointed
+	PrunedRows int `json:"pruned_rows"`
+	// Whether a pruneSafe backup row was left behind by a failed prune
+	PruneBackup bool `json:"prune_backup"`
+}
+
+/**
+ * Records the current transaction as the last update of a variable within a bucket
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param bucket The bucket of the update
+ * @param txTime The transaction timestamp in nanoseconds
+ *
+ * @return An error if the marker could not be written
+ */
+func putMarker(APIstub shim.ChaincodeStubInterface, name string, bucket string, txTime int64) error {
+	markerKey, compositeErr := APIstub.CreateCompositeKey(registryIndex, []string{name, bucket})
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+
+	markerBytes, marshalErr := json.Marshal(marker{TxID: APIstub.GetTxID(), Time: txTime})
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	markerPutErr := APIstub.PutState(markerKey, markerBytes)
+	if markerPutErr != nil {
+		return fmt.Errorf("Could not register the update of %s: %s", name, markerPutErr.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Retrieves the registry row of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The composite key of the row, the registration or nil if the variable is not registered, or an error
+ */
+func getRegistration(APIstub shim.ChaincodeStubInterface, name string) (string, *registration, error) {
+	variableKey, compositeErr := APIstub.CreateCompositeKey(variableIndex, []string{name})
+	if compositeErr != nil {
+		return "", nil, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+
+	variableBytes, variableErr := APIstub.GetState(variableKey)
+	if variableErr != nil {
+		return "", nil, fmt.Errorf("Could not retrieve the registration of %s: %s", name, variableErr.Error())
+	}
+	if variableBytes == nil {
+		return variableKey, nil, nil
+	}
+
+	r := &registration{}
+	unmarshalErr := json.Unmarshal(variableBytes, r)
+	if unmarshalErr != nil {
+		return "", nil, fmt.Errorf("Could not read the registration of %s: %s", name, unmarshalErr.Error())
+	}
+
+	return variableKey, r, nil
+}
+
+/**
+ * Writes the registry row of a variable without reading it
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param r The registry row
+ *
+ * @return An error if the row could not be written
+ */
+func putRegistration(APIstub shim.ChaincodeStubInterface, name string, r registration) error {
+	variableKey, compositeErr := APIstub.CreateCompositeKey(variableIndex, []string{name})
+	if compositeErr != nil {
+		return fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+
+	variableBytes, marshalErr := json.Marshal(r)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	variablePutErr := APIstub.PutState(variableKey, variableBytes)
+	if variablePutErr != nil {
+		return fmt.Errorf("Could not register %s: %s", name, variablePutErr.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Finds the first update of a variable among the deltas of its oldest bucket
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param bucket The oldest bucket of the variable
+ *
+ * @return The transaction ID and timestamp of the first update, empty if the bucket has no deltas
+ */
+func firstUpdate(APIstub shim.ChaincodeStubInterface, name string, bucket string) (string, int64, error) {
+	deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(deltaBucketIndex, []string{name, bucket})
+	if deltaErr != nil {
+		return "", 0, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error())
+	}
+	defer deltaResultsIterator.Close()
+
+	var txID string
+	var txTime int64
+	for deltaResultsIterator.HasNext() {
+		responseRange, nextErr := deltaResultsIterator.Next()
+		if nextErr != nil {
+			return "", 0, nextErr
+		}
+		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+		if splitKeyErr != nil {
+			return "", 0, splitKeyErr
+		}
+
+		rowTime, convErr := strconv.ParseInt(string(responseRange.Value), 10, 64)
+		if convErr != nil {
+			return "", 0, fmt.Errorf("Could not read the timestamp of a delta of %s: %s", name, convErr.Error())
+		}
+		if txID == "" || rowTime < txTime {
+			txID = keyParts[4]
+			txTime = rowTime
+		}
+	}
+
+	// Deltas recorded by updatebatch are keyed by the transaction ID followed by their position in the batch
+	if dot := strings.Index(txID, "."); dot >= 0 {
+		txID = txID[:dot]
+	}
+
+	return txID, txTime, nil
+}
+
+/**
+ * Describes a registered variable, looking up its first update if it was not declared with create
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param r The registry row of the variable
+ *
+ * @return The registry entry of the variable
+ */
+func describeVariable(APIstub shim.ChaincodeStubInterface, name string, r registration) (varInfo, error) {
+	info := varInfo{Name: name, Declared: r.Declared, CreatedTxID: r.TxID, Created: r.Time}
+	if info.CreatedTxID != "" {
+		return info, nil
+	}
+
+	// The first checkpoint records the first update, before that it is still among the deltas
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return info, latestErr
+	}
+	if latest != nil {
+		info.CreatedTxID = latest.CreatedTxID
+		info.Created = latest.Created
+		return info, nil
+	}
+
+	oldest, pendingErr := oldestPendingBucket(APIstub, name)
+	if pendingErr != nil || oldest == "" {
+		return info, pendingErr
+	}
+	var firstErr error
+	info.CreatedTxID, info.Created, firstErr = firstUpdate(APIstub, name, oldest)
+	return info, firstErr
+}
+
+/**
+ * Reads the registry markers of a variable, which are ordered by bucket
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The first bucket with a marker, empty if there is none, and the marker of the last update
+ */
+func readMarkers(APIstub shim.ChaincodeStubInterface, name string) (string, marker, error) {
+	var first string
+	last := marker{}
+
+	markerResultsIterator, markerErr := APIstub.GetStateByPartialCompositeKey(registryIndex, []string{name})
+	if markerErr != nil {
+		return "", last, fmt.Errorf("Could not retrieve the registry markers of %s: %s", name, markerErr.Error())
+	}
+	defer markerResultsIterator.Close()
+
+	for markerResultsIterator.HasNext() {
+		responseRange, nextErr := markerResultsIterator.Next()
+		if nextErr != nil {
+			return "", last, nextErr
+		}
+
+		if first == "" {
+			_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+			if splitKeyErr != nil {
+				return "", last, splitKeyErr
+			}
+			first = keyParts[1]
+		}
+
+		// The last marker read holds the latest update
+		unmarshalErr := json.Unmarshal(responseRange.Value, &last)
+		if unmarshalErr != nil {
+			return "", last, fmt.Errorf("Could not read the registry marker of %s: %s", name, unmarshalErr.Error())
+		}
+	}
+
+	return first, last, nil
+}
+
+/**
+ * Counts the delta rows of a variable
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ *
+ * @return The number of delta rows in the ledger
+ */
+func countDeltas(APIstub shim.ChaincodeStubInterface, name string) (int, error) {
+	var count int
+	for _, index := range []string{deltaIndex, deltaBucketIndex} {
+		deltaResultsIterator, deltaErr := APIstub.GetStateByPartialCompositeKey(index, []string{name})
+		if deltaErr != nil {
+			return 0, fmt.Errorf("Could not retrieve delta rows for %s: %s", name, deltaErr.Error())
+		}
+		for deltaResultsIterator.HasNext() {
+			_, nextErr := deltaResultsIterator.Next()
+			if nextErr != nil {
+				deltaResultsIterator.Close()
+				return 0, nextErr
+			}
+			count++
+		}
+		deltaResultsIterator.Close()
+	}
+
+	return count, nil
+}
+
+/**
+ * Lists every registered variable in order of name, along with when it was created. The args array is expected
+ * to be empty.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the list invocation
+ *
+ * @return A response structure with a JSON array of variables
+ */
+func (s *SmartContract) list(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments, expecting 0")
+	}
+
+	variableResultsIterator, variableErr := APIstub.GetStateByPartialCompositeKey(variableIndex, []string{})
+	if variableErr != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the registry: %s", variableErr.Error()))
+	}
+	defer variableResultsIterator.Close()
+
+	results := []varInfo{}
+	for variableResultsIterator.HasNext() {
+		responseRange, nextErr := variableResultsIterator.Next()
+		if nextErr != nil {
+			return shim.Error(nextErr.Error())
+		}
+		_, keyParts, splitKeyErr := APIstub.SplitCompositeKey(responseRange.Key)
+		if splitKeyErr != nil {
+			return shim.Error(splitKeyErr.Error())
+		}
+
+		r := registration{}
+		unmarshalErr := json.Unmarshal(responseRange.Value, &r)
+		if unmarshalErr != nil {
+			return shim.Error(fmt.Sprintf("Could not read the registration of %s: %s", keyParts[0], unmarshalErr.Error()))
+		}
+		info, describeErr := describeVariable(APIstub, keyParts[0], r)
+		if describeErr != nil {
+			return shim.Error(describeErr.Error())
+		}
+		results = append(results, info)
+	}
+
+	resultsBytes, marshalErr := json.Marshal(results)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+
+	return shim.Success(resultsBytes)
+}
+
+/**
+ * Registers variables which were created before the registry was introduced, so that list includes them
+ * without waiting for their next update. Variables which do not exist are skipped. The args array contains the
+ * names of the variables to register.
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the register invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) register(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) == 0 {
+		return shim.Error("Incorrect number of arguments, expecting at least 1")
+	}
+
+	var registered int
+	for _, name := range args {
+		_, r, registrationErr := getRegistration(APIstub, name)
+		if registrationErr != nil {
+			return shim.Error(registrationErr.Error())
+		}
+		if r != nil {
+			continue
+		}
+
+		// Ensure the variable exists
+		_, declared, configErr := getVarConfig(APIstub, name)
+		if configErr != nil {
+			return shim.Error(configErr.Error())
+		}
+		updated, deltaErr := hasDeltas(APIstub, name)
+		if deltaErr != nil {
+			return shim.Error(deltaErr.Error())
+		}
+		latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+		if latestErr != nil {
+			return shim.Error(latestErr.Error())
+		}
+		if !declared && !updated && latest == nil {
+			continue
+		}
+
+		registerErr := putRegistration(APIstub, name, registration{Declared: declared})
+		if registerErr != nil {
+			return shim.Error(registerErr.Error())
+		}
+		registered++
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Registered %d of %d variables", registered, len(args))))
+}
+
+/**
+ * Retrieves the statistics of a variable: when it was created and first and last updated, how many delta rows it has,
+ * how far it has been checkpointed and pruned and whether a prune backup is outstanding. The args array
+ * contains the following argument:
+ *	- args[0] -> The name of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the stats invocation
+ *
+ * @return A response structure with the statistics as JSON
+ */
+func (s *SmartContract) stats(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	config, declared, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
+	}
+	result := varStats{varInfo: varInfo{Name: name, Declared: declared}, Mode: config.Mode}
+
+	_, r, registrationErr := getRegistration(APIstub, name)
+	if registrationErr != nil {
+		return shim.Error(registrationErr.Error())
+	}
+	if r != nil {
+		var describeErr error
+		result.varInfo, describeErr = describeVariable(APIstub, name, *r)
+		if describeErr != nil {
+			return shim.Error(describeErr.Error())
+		}
+	}
+
+	var last marker
+	var markerErr error
+	result.FirstBucket, last, markerErr = readMarkers(APIstub, name)
+	if markerErr != nil {
+		return shim.Error(markerErr.Error())
+	}
+	result.LastTxID = last.TxID
+	result.LastTime = last.Time
+
+	var countErr error
+	result.DeltaRows, countErr = countDeltas(APIstub, name)
+	if countErr != nil {
+		return shim.Error(countErr.Error())
+	}
+
+	latest, latestErr := getCheckpoint(APIstub, latestCheckpointIndex, []string{name})
+	if latestErr != nil {
+		return shim.Error(latestErr.Error())
+	}
+	if latest != nil {
+		result.CheckpointedTo = latest.Bucket
+	}
+
+	// Ensure the variable exists
+	if !declared && r == nil && result.DeltaRows == 0 && latest == nil {
+		return shim.Error(fmt.Sprintf("No variable by the name %s exists", name))
+	}
+
+	_, cursor, cursorErr := getPruneCursor(APIstub, name)
+	if cursorErr != nil {
+		return shim.Error(cursorErr.Error())
+	}
+	result.PrunedRows = cursor.Pruned
+
+	backupBytes, backupErr := APIstub.GetState(fmt.Sprintf("%s_PRUNE_BACKUP", name))
+	if backupErr != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve the prune backup of %s: %s", name, backupErr.Error()))
+	}
+	result.PruneBackup = backupBytes != nil
+
+	resultBytes, marshalErr := json.Marshal(result)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+
+	return shim.Success(resultBytes)
+}
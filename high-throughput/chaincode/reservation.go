@@ -0,0 +1,333 @@
+/*
+ * Copyright IBM Corp All Rights Reserved
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ *
+ * Reservations. A floor is only enforced when a variable is aggregated, so a "-" update can still be accepted
+ * and later left out of the value. Where an overdraft has to be rejected when it is submitted, an amount is
+ * first reserved out of the variable, which reads the whole variable and so conflicts with concurrent updates
+ * to it, and is then debited from the reservation. Each reservation is its own row, so debits only conflict
+ * with debits against the same reservation; a client or teller holding its own reservation is never slowed
+ * down by others. Whatever is left of a reservation is returned to the variable when it is released.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	sc "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Composite key under which reservations are stored
+const reservationIndex = "reservation~varName~reservationID"
+
+// reservation is an amount taken out of a variable to be debited from
+type reservation struct {
+	ReservationID string `json:"reservation_id"`
+	Reserved      string `json:"reserved"`
+	Remaining     string `json:"remaining"`
+}
+
+/**
+ * Retrieves a reservation
+ *
+ * @param APIstub The chaincode shim
+ * @param name The name of the variable
+ * @param reservationID The ID of the reservation, the txID of the reserve invocation
+ *
+ * @return The composite key of the reservation, the reservation or nil if it does not exist, or an error
+ */
+func getReservation(APIstub shim.ChaincodeStubInterface, name string, reservationID string) (string, *reservation, error) {
+	reservationKey, compositeErr := APIstub.CreateCompositeKey(reservationIndex, []string{name, reservationID})
+	if compositeErr != nil {
+		return "", nil, fmt.Errorf("Could not create a composite key for %s: %s", name, compositeErr.Error())
+	}
+
+	reservationBytes, getErr := APIstub.GetState(reservationKey)
+	if getErr != nil {
+		return "", nil, fmt.Errorf("Could not retrieve reservation %s of %s: %s", reservationID, name, getErr.Error())
+	}
+	if reservationBytes == nil {
+		return reservationKey, nil, nil
+	}
+
+	r := &reservation{}
+	unmarshalErr := json.Unmarshal(reservationBytes, r)
+	if unmarshalErr != nil {
+		return "", nil, fmt.Errorf("Could not read reservation %s of %s: %s", reservationID, name, unmarshalErr.Error())
+	}
+
+	return reservationKey, r, nil
+}
+
+/**
+ * Stores a reservation
+ *
+ * @param APIstub The chaincode shim
+ * @param reservationKey The composite key of the reservation
+ * @param r The reservation
+ *
+ * @return An error if the reservation could not be stored
+ */
+func putReservation(APIstub shim.ChaincodeStubInterface, reservationKey string, r *reservation) error {
+	reservationBytes, marshalErr := json.Marshal(r)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	reservationPutErr := APIstub.PutState(reservationKey, reservationBytes)
+	if reservationPutErr != nil {
+		return fmt.Errorf("Could not put reservation %s in the ledger: %s", r.ReservationID, reservationPutErr.Error())
+	}
+
+	return nil
+}
+
+/**
+ * Parses an amount to reserve or debit, which must be above zero
+ *
+ * @param config The configuration of the variable
+ * @param value The amount
+ *
+ * @return The amount, or an error if it is not valid for the variable
+ */
+func parseAmount(config varConfig, value string) (*aggregate, error) {
+	validateErr := config.validate("-", value)
+	if validateErr != nil {
+		return nil, validateErr
+	}
+
+	amount, parseErr := valueOf(config, value)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if amount.cmp(newAggregate(config)) <= 0 {
+		return nil, fmt.Errorf("Amount must be above zero")
+	}
+
+	return amount, nil
+}
+
+/**
+ * Reserves an amount out of a variable with a floor. The variable's value is checked against the floor and the
+ * amount recorded as a "-" delta in the same transaction. The args array contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The amount to reserve
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the reserve invocation
+ *
+ * @return A response structure with the reservation ID, or failure with a message
+ */
+func (s *SmartContract) reserve(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	config, _, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
+	}
+	if config.Floor == "" {
+		return shim.Error(fmt.Sprintf("Variable %s has no floor to reserve against", name))
+	}
+	amount, amountErr := parseAmount(config, args[1])
+	if amountErr != nil {
+		return shim.Error(amountErr.Error())
+	}
+
+	// Make sure the reservation leaves the variable at or above its floor
+	val, err := computeAggregate(APIstub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	applyErr := val.apply(delta{op: "-", value: args[1]})
+	if applyErr != nil {
+		return shim.Error(applyErr.Error())
+	}
+	floor, floorErr := valueOf(config, config.Floor)
+	if floorErr != nil {
+		return shim.Error(floorErr.Error())
+	}
+	if val.cmp(floor) < 0 {
+		return shim.Error(fmt.Sprintf("Reserving %s would take %s below its floor of %s", args[1], name, config.Floor))
+	}
+
+	// Take the amount out of the variable and hold it in the reservation
+	updateResp := s.update(APIstub, []string{name, args[1], "-"})
+	if updateResp.Status != OK {
+		return updateResp
+	}
+
+	reservationID := APIstub.GetTxID()
+	reservationKey, _, reservationErr := getReservation(APIstub, name, reservationID)
+	if reservationErr != nil {
+		return shim.Error(reservationErr.Error())
+	}
+	putErr := putReservation(APIstub, reservationKey, &reservation{ReservationID: reservationID, Reserved: amount.String(), Remaining: amount.String()})
+	if putErr != nil {
+		return shim.Error(putErr.Error())
+	}
+
+	return shim.Success([]byte(reservationID))
+}
+
+/**
+ * Debits an amount from a reservation, rejecting it if the reservation does not hold enough. The args array
+ * contains the following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The reservation ID returned by reserve
+ *	- args[2] -> The amount to debit
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the debit invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) debit(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments, expecting 3")
+	}
+
+	name := args[0]
+	reservationID := args[1]
+	config, _, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
+	}
+	amount, amountErr := parseAmount(config, args[2])
+	if amountErr != nil {
+		return shim.Error(amountErr.Error())
+	}
+
+	reservationKey, r, reservationErr := getReservation(APIstub, name, reservationID)
+	if reservationErr != nil {
+		return shim.Error(reservationErr.Error())
+	}
+	if r == nil {
+		return shim.Error(fmt.Sprintf("No reservation %s exists for %s", reservationID, name))
+	}
+
+	remaining, remainingErr := valueOf(config, r.Remaining)
+	if remainingErr != nil {
+		return shim.Error(remainingErr.Error())
+	}
+	if remaining.cmp(amount) < 0 {
+		return shim.Error(fmt.Sprintf("Reservation %s only has %s remaining", reservationID, r.Remaining))
+	}
+	applyErr := remaining.apply(delta{op: "-", value: args[2]})
+	if applyErr != nil {
+		return shim.Error(applyErr.Error())
+	}
+
+	r.Remaining = remaining.String()
+	putErr := putReservation(APIstub, reservationKey, r)
+	if putErr != nil {
+		return shim.Error(putErr.Error())
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Successfully debited %s from reservation %s, %s remaining", args[2], reservationID, r.Remaining)))
+}
+
+/**
+ * Closes a reservation, returning whatever remains of it to the variable. The args array contains the
+ * following arguments:
+ *	- args[0] -> The name of the variable
+ *	- args[1] -> The reservation ID returned by reserve
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the release invocation
+ *
+ * @return A response structure indicating success or failure with a message
+ */
+func (s *SmartContract) release(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 2 {
+		return shim.Error("Incorrect number of arguments, expecting 2")
+	}
+
+	name := args[0]
+	reservationID := args[1]
+	config, _, configErr := getVarConfig(APIstub, name)
+	if configErr != nil {
+		return shim.Error(configErr.Error())
+	}
+
+	reservationKey, r, reservationErr := getReservation(APIstub, name, reservationID)
+	if reservationErr != nil {
+		return shim.Error(reservationErr.Error())
+	}
+	if r == nil {
+		return shim.Error(fmt.Sprintf("No reservation %s exists for %s", reservationID, name))
+	}
+
+	// Return the remainder to the variable
+	remaining, remainingErr := valueOf(config, r.Remaining)
+	if remainingErr != nil {
+		return shim.Error(remainingErr.Error())
+	}
+	if remaining.cmp(newAggregate(config)) > 0 {
+		updateResp := s.update(APIstub, []string{name, r.Remaining, "+"})
+		if updateResp.Status != OK {
+			return updateResp
+		}
+	}
+
+	delErr := APIstub.DelState(reservationKey)
+	if delErr != nil {
+		return shim.Error(fmt.Sprintf("Could not delete reservation %s: %s", reservationID, delErr.Error()))
+	}
+
+	return shim.Success([]byte(fmt.Sprintf("Released reservation %s, %s returned to %s", reservationID, r.Remaining, name)))
+}
+
+/**
+ * Lists the open reservations of a variable. The args array contains the following argument:
+ *	- args[0] -> The name of the variable
+ *
+ * @param APIstub The chaincode shim
+ * @param args The arguments array for the reservations invocation
+ *
+ * @return A response structure with a JSON array of reservations
+ */
+func (s *SmartContract) reservations(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	// Check we have a valid number of args
+	if len(args) != 1 {
+		return shim.Error("Incorrect number of arguments, expecting 1")
+	}
+
+	name := args[0]
+	reservationResultsIterator, reservationErr := APIstub.GetStateByPartialCompositeKey(reservationIndex, []string{name})
+	if reservationErr != nil {
+		return shim.Error(fmt.Sprintf("Could not retrieve reservations for %s: %s", name, reservationErr.Error()))
+	}
+	defer reservationResultsIterator.Close()
+
+	results := []reservation{}
+	for reservationResultsIterator.HasNext() {
+		responseRange, nextErr := reservationResultsIterator.Next()
+		if nextErr != nil {
+			return shim.Error(nextErr.Error())
+		}
+
+		r := reservation{}
+		unmarshalErr := json.Unmarshal(responseRange.Value, &r)
+		if unmarshalErr != nil {
+			return shim.Error(fmt.Sprintf("Could not read a reservation of %s: %s", name, unmarshalErr.Error()))
+		}
+		results = append(results, r)
+	}
+
+	resultsBytes, marshalErr := json.Marshal(results)
+	if marshalErr != nil {
+		return shim.Error(marshalErr.Error())
+	}
+
+	return shim.Success(resultsBytes)
+}